@@ -0,0 +1,50 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestAuditLogin(t *testing.T) {
+	router := api.NewRouter()
+	admin := adminSession(t, router, "audit-admin")
+
+	attemptLogin(router, "audit-user", "hunter2", "192.0.2.30:1234")
+
+	var entries []structs.AuditEntry
+	w := serve(router, "GET", "/api/v0/audit?action=login&target=audit-user", "192.0.2.99:1234", nil,
+		map[string]string { "Cookie": admin })
+	areEqual("status", http.StatusOK, w.Code, t)
+
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatalf("Unable to decode audit log: %s", err)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 audit entry but found %d", len(entries))
+	}
+
+	entry := entries[0]
+	areEqual("username", "audit-user", entry.Username, t)
+	areEqual("ip", "192.0.2.30", entry.IP, t)
+	areEqual("result", "failure", entry.Result, t)
+	areEqual("username parameter", "audit-user", entry.Parameters["Username"], t)
+	areEqual("redacted password", "[redacted]", entry.Parameters["Password"], t)
+
+	// Entries can't be read without the admin permission
+	viewer := newToken(t, "audit-viewer", structs.RoleViewer, structs.PermView)
+	w = serve(router, "GET", "/api/v0/audit", "192.0.2.99:1234", nil, map[string]string { "Authorization": viewer })
+	areEqual("viewer", http.StatusForbidden, w.Code, t)
+
+	// or with an API token, even one with the admin scope
+	token := newToken(t, "audit-admin", structs.RoleAdmin, structs.PermAdmin)
+	w = serve(router, "GET", "/api/v0/audit", "192.0.2.99:1234", nil, map[string]string { "Authorization": token })
+	areEqual("admin token", http.StatusForbidden, w.Code, t)
+}
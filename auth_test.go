@@ -0,0 +1,151 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestInScope(t *testing.T) {
+	scopes := []string { "tank/team", "backup" }
+
+	areEqual("unrestricted", true, api.InScope(nil, "anything/at/all"), t)
+	areEqual("scoped dataset", true, api.InScope(scopes, "tank/team"), t)
+	areEqual("child dataset", true, api.InScope(scopes, "tank/team/child"), t)
+	areEqual("snapshot", true, api.InScope(scopes, "tank/team@daily"), t)
+	areEqual("path in snapshot", true, api.InScope(scopes, "/tank/team/.zfs/snapshot/daily/file"), t)
+	areEqual("whole pool", true, api.InScope(scopes, "backup/anything"), t)
+
+	areEqual("parent pool", false, api.InScope(scopes, "tank"), t)
+	areEqual("sibling dataset", false, api.InScope(scopes, "tank/other"), t)
+	areEqual("shared prefix", false, api.InScope(scopes, "tank/teammates"), t)
+	areEqual("sibling snapshot", false, api.InScope(scopes, "tank/other@daily"), t)
+	areEqual("path traversal", false, api.InScope(scopes, "/tank/team/../other/file"), t)
+}
+
+func TestPoolVisible(t *testing.T) {
+	scopes := []string { "tank/team" }
+
+	areEqual("pool containing scope", true, api.PoolVisible(scopes, "tank"), t)
+	areEqual("unrelated pool", false, api.PoolVisible(scopes, "backup"), t)
+	areEqual("unrestricted", true, api.PoolVisible(nil, "backup"), t)
+}
+
+// Creates a user with role (if it doesn't exist) and an API token for it with the given scopes. Returns the value of
+// the Authorization header to use the token with.
+func newToken(t *testing.T, username string, role string, scopes ...string) string {
+	if !config.IsUser(username) {
+		if err := config.CreateUser(username, "", role, nil); err != nil {
+			t.Fatalf("Unable to create user %s: %s", username, err)
+		}
+	}
+
+	token := structs.Token {
+		ID:       crypto.GetRandom(8),
+		Username: username,
+		Scopes:   scopes,
+		Created:  time.Now().Unix(),
+	}
+	secret := crypto.GetRandom(32)
+
+	if err := config.SaveToken(token, crypto.HashToken(secret)); err != nil {
+		t.Fatalf("Unable to save token: %s", err)
+	}
+
+	return "Bearer lg_" + token.ID + "_" + secret
+}
+
+// Creates a request from remote (an "address:port") with the given headers. If form isn't nil, it is sent as the
+// request body.
+func newRequest(method string, path string, remote string, form url.Values, headers map[string]string) *http.Request {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	r := httptest.NewRequest(method, path, body)
+	r.RemoteAddr = remote
+
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+
+	return r
+}
+
+// Sends a request created by newRequest through the router
+func serve(router http.Handler, method string, path string, remote string, form url.Values, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newRequest(method, path, remote, form, headers))
+
+	return w
+}
+
+// Returns headers that pass the CSRF check along with any extra cookies
+func csrfHeaders(cookies ...string) map[string]string {
+	return map[string]string {
+		"Cookie":       strings.Join(append([]string { "CSRF=test" }, cookies...), "; "),
+		"X-CSRF-Token": "test",
+	}
+}
+
+func TestRoles(t *testing.T) {
+	areEqual("viewer can view", true, structs.RoleHasPermission(structs.RoleViewer, structs.PermView), t)
+	areEqual("viewer can't browse", false, structs.RoleHasPermission(structs.RoleViewer, structs.PermBrowse), t)
+	areEqual("operator can maintain", true, structs.RoleHasPermission(structs.RoleOperator, structs.PermMaintain), t)
+	areEqual("operator isn't admin", false, structs.RoleHasPermission(structs.RoleOperator, structs.PermAdmin), t)
+	areEqual("admin is admin", true, structs.RoleHasPermission(structs.RoleAdmin, structs.PermAdmin), t)
+	areEqual("unknown role", false, structs.RoleHasPermission("root", structs.PermView), t)
+	areEqual("unknown permission", false, structs.RoleHasPermission(structs.RoleAdmin, "sudo"), t)
+
+	areEqual("is role", true, structs.IsRole(structs.RoleOperator), t)
+	areEqual("isn't role", false, structs.IsRole("root"), t)
+}
+
+func TestRolePermissions(t *testing.T) {
+	router := api.NewRouter()
+
+	tests := []struct {
+		name   string
+		role   string
+		path   string
+		status int
+	}{
+		{ "viewer views", structs.RoleViewer, "/api/v0/properties/Datasets", http.StatusOK },
+		{ "viewer administers", structs.RoleViewer, "/api/v0/lockouts", http.StatusForbidden },
+		{ "operator administers", structs.RoleOperator, "/api/v0/lockouts", http.StatusForbidden },
+		{ "admin administers", structs.RoleAdmin, "/api/v0/lockouts", http.StatusOK },
+	}
+
+	for _, test := range tests {
+		// Administrative routes can't be used with API tokens, so each role logs in
+		username := "role-" + test.role
+		if !config.IsUser(username) {
+			config.CreateUser(username, crypto.HashPassword("password"), test.role, nil)
+		}
+
+		cookie := login(t, router, username, "password", "192.0.2.1:1234")
+		w := serve(router, "GET", test.path, "192.0.2.1:1234", nil, map[string]string { "Cookie": cookie })
+
+		areEqual(test.name, test.status, w.Code, t)
+	}
+
+	w := serve(router, "GET", "/api/v0/properties/Datasets", "192.0.2.1:1234", nil, nil)
+	areEqual("anonymous", http.StatusForbidden, w.Code, t)
+}
@@ -0,0 +1,526 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFormatPermissions(t *testing.T) {
+	areEqual("regular file", "-rw-r--r--", api.FormatPermissions("f", "0644"), t)
+	areEqual("directory", "drwxr-xr-x", api.FormatPermissions("d", "0755"), t)
+	areEqual("symlink", "lrwxrwxrwx", api.FormatPermissions("l", "0777"), t)
+	areEqual("setuid", "-r-sr-xr-x", api.FormatPermissions("f", "4555"), t)
+	areEqual("setgid without execute", "-rw-r-Sr--", api.FormatPermissions("f", "2644"), t)
+	areEqual("sticky", "drwxrwxrwt", api.FormatPermissions("d", "1777"), t)
+	areEqual("invalid mode", "", api.FormatPermissions("f", "abc"), t)
+}
+
+func TestIsAllowed(t *testing.T) {
+	allowed := "/tank/share, /backup/"
+
+	areEqual("allowed directory", true, browser.IsAllowed("/tank/share", allowed), t)
+	areEqual("child", true, browser.IsAllowed("/tank/share/docs/file.txt", allowed), t)
+	areEqual("trailing slash", true, browser.IsAllowed("/backup/daily", allowed), t)
+	areEqual("traversal within", true, browser.IsAllowed("/tank/share/a/../b", allowed), t)
+
+	areEqual("parent", false, browser.IsAllowed("/tank", allowed), t)
+	areEqual("shared prefix", false, browser.IsAllowed("/tank/shared", allowed), t)
+	areEqual("traversal", false, browser.IsAllowed("/tank/share/../../etc/shadow", allowed), t)
+	areEqual("relative", false, browser.IsAllowed("tank/share", allowed), t)
+	areEqual("empty entry", false, browser.IsAllowed("/etc", "/tank,,"), t)
+	areEqual("root", true, browser.IsAllowed("/etc", "/"), t)
+}
+
+func TestMatchName(t *testing.T) {
+	areEqual("substring", true, browser.MatchName("port", "Report.pdf"), t)
+	areEqual("case insensitive", true, browser.MatchName("REPORT", "report.pdf"), t)
+	areEqual("glob", true, browser.MatchName("*.pdf", "report.pdf"), t)
+	areEqual("single character", true, browser.MatchName("file?.txt", "file1.txt"), t)
+	areEqual("class", true, browser.MatchName("[ab].txt", "b.txt"), t)
+
+	areEqual("no substring", false, browser.MatchName("invoice", "report.pdf"), t)
+	areEqual("glob is whole name", false, browser.MatchName("*.pdf", "report.pdf.bak"), t)
+	areEqual("glob is case sensitive", false, browser.MatchName("*.PDF", "report.pdf"), t)
+	areEqual("invalid glob", false, browser.MatchName("[", "["), t)
+}
+
+func TestProtocolListing(t *testing.T) {
+	var buf bytes.Buffer
+
+	sent := browser.Message {
+		Type: browser.TypeListing,
+		Name: "/test",
+		Entries: []browser.Entry {
+			{ Type: "f", Name: "name with spaces\n", Size: 3, Mode: 0644, Owner: "root", Group: "root" },
+			{ Type: "l", Name: "link", Target: "../target" },
+		},
+	}
+
+	if err := browser.WriteMessage(&buf, sent); err != nil {
+		t.Fatalf("Unable to write message: %s", err)
+	}
+
+	received, err := browser.ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("Unable to read message: %s", err)
+	}
+
+	sent.Version = browser.Version
+	if !cmp.Equal(&sent, received) {
+		t.Errorf("Error testing listing - expected %#v but found %#v.", sent, received)
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	var buf bytes.Buffer
+
+	browser.WriteMessage(&buf, browser.Message {
+		Type:  browser.TypeError,
+		Code:  browser.ErrTooLarge,
+		Error: "too many files",
+	})
+
+	_, err := browser.ReadMessage(&buf)
+
+	var browserErr *browser.Error
+	if !errors.As(err, &browserErr) {
+		t.Fatalf("Error testing error message - expected *browser.Error but found %#v", err)
+	}
+
+	areEqual("error code", browser.ErrTooLarge, browserErr.Code, t)
+	areEqual("error message", "too many files", browserErr.Message, t)
+}
+
+func TestProtocolPayload(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := browser.NewPayloadWriter(&buf)
+	w.Write([]byte("hello "))
+	w.Write([]byte("world"))
+	w.Close()
+
+	complete := buf.Bytes()
+
+	read, err := ioutil.ReadAll(browser.NewPayloadReader(bytes.NewReader(complete)))
+	if err != nil {
+		t.Fatalf("Unable to read payload: %s", err)
+	}
+	areEqual("payload", "hello world", string(read), t)
+
+	// Drop the terminating frame to simulate the browser exiting part of the way through
+	_, err = ioutil.ReadAll(browser.NewPayloadReader(bytes.NewReader(complete[:len(complete) - 4])))
+	areEqual("truncated payload", io.ErrUnexpectedEOF, err, t)
+}
+
+// Creates each of the files (and the directories containing them) under root
+func createFiles(t *testing.T, root string, files ...string) {
+	for _, file := range files {
+		path := filepath.Join(root, file)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Unable to create directory for %s: %s", file, err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatalf("Unable to create %s: %s", file, err)
+		}
+	}
+}
+
+// Returns the names of the entries in msg separated by commas
+func entryNames(msg browser.Message) string {
+	names := make([]string, 0, len(msg.Entries))
+	for _, entry := range msg.Entries {
+		names = append(names, entry.Name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestSearch(t *testing.T) {
+	root := t.TempDir()
+	createFiles(t, root, "a/report.txt", "a/b/report.txt", "a/b/c/report.txt", "other.txt", ".zfs/snapshot/daily/report.txt")
+
+	unlimited := browser.SearchLimits { Depth: 32, Results: 100, Budget: time.Minute }
+
+	tests := []struct {
+		name      string
+		pattern   string
+		limits    browser.SearchLimits
+		expected  string
+		truncated bool
+	}{
+		{ "substring", "report", unlimited, "a/b/c/report.txt,a/b/report.txt,a/report.txt", false },
+		{ "glob", "*.txt", unlimited, "a/b/c/report.txt,a/b/report.txt,a/report.txt,other.txt", false },
+		{ "directories", "b", unlimited, "a/b", false },
+		{ "depth", "report", browser.SearchLimits { Depth: 2, Results: 100, Budget: time.Minute }, "a/report.txt", true },
+		{ "results", "report", browser.SearchLimits { Depth: 32, Results: 2, Budget: time.Minute },
+			"a/b/c/report.txt,a/b/report.txt", true },
+		{ "budget", "report", browser.SearchLimits { Depth: 32, Results: 100 }, "", true },
+	}
+
+	for _, test := range tests {
+		msg, err := browser.Search(root, test.pattern, test.limits)
+		if err != nil {
+			t.Errorf("Error testing %s - unable to search: %s", test.name, err)
+			continue
+		}
+
+		areEqual(test.name, test.expected, entryNames(msg), t)
+		areEqual(test.name + " truncated", test.truncated, msg.Truncated, t)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dataset")
+	outside := filepath.Join(dir, "outside")
+
+	snapshots := filepath.Join(root, ".zfs", "snapshot")
+	createFiles(t, snapshots, "one/docs/file.txt", "three/docs/file.txt", "two/docs/other.txt", "escape/placeholder")
+	createFiles(t, outside, "file.txt")
+
+	// In one snapshot, the directory containing the file is a link to somewhere that isn't allowed
+	if err := os.Symlink(outside, filepath.Join(snapshots, "escape", "docs")); err != nil {
+		t.Fatalf("Unable to create symlink: %s", err)
+	}
+
+	// Links at the end of the path are reported as links and not followed
+	if err := os.Symlink("/etc/passwd", filepath.Join(snapshots, "one", "docs", "link")); err != nil {
+		t.Fatalf("Unable to create symlink: %s", err)
+	}
+
+	allowed, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatalf("Unable to resolve %s: %s", root, err)
+	}
+
+	msg, err := browser.History(root, "docs/file.txt", allowed)
+	if err != nil {
+		t.Fatalf("Unable to search snapshots: %s", err)
+	}
+	areEqual("snapshots", "one,three", entryNames(msg), t)
+	areEqual("name", "docs/file.txt", msg.Name, t)
+
+	msg, _ = browser.History(root, "/../docs/link", allowed)
+	areEqual("link", "one", entryNames(msg), t)
+	areEqual("link type", "l", msg.Entries[0].Type, t)
+	areEqual("link target", "/etc/passwd", msg.Entries[0].Target, t)
+
+	var browserErr *browser.Error
+	_, err = browser.History(root, "/", allowed)
+	areEqual("empty path", true, errors.As(err, &browserErr) && browserErr.Code == browser.ErrInvalidArgument, t)
+
+	_, err = browser.History(outside, "file.txt", allowed)
+	areEqual("no snapshots", true, os.IsNotExist(err), t)
+}
+
+// Returns the error code that the browser helper would report for err, or an empty string if err is nil
+func browserCode(err error) string {
+	var browserErr *browser.Error
+
+	if err == nil {
+		return ""
+	} else if errors.As(err, &browserErr) {
+		return browserErr.Code
+	} else if os.IsNotExist(err) {
+		return browser.ErrNotFound
+	}
+
+	return browser.ErrInternal
+}
+
+// Creates a temporary directory with an allowed directory (and a link to it) and a directory outside of it.
+// Returns the temporary directory with any symlinks in its path resolved.
+func createBrowserTree(t *testing.T) string {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("Unable to resolve temporary directory: %s", err)
+	}
+
+	createFiles(t, dir, "share/a.txt", "share/sub/b.txt", "outside/secret.txt")
+
+	links := map[string]string {
+		"share/escape":   filepath.Join(dir, "outside"),
+		"share/secret":   filepath.Join(dir, "outside", "secret.txt"),
+		"share/inside":   "sub/b.txt",
+		"share/dangling": filepath.Join(dir, "missing"),
+		"link":           filepath.Join(dir, "share"),
+	}
+
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Unable to create symlink %s: %s", name, err)
+		}
+	}
+
+	if err := syscall.Mkfifo(filepath.Join(dir, "share", "pipe"), 0644); err != nil {
+		t.Fatalf("Unable to create FIFO: %s", err)
+	}
+
+	return dir
+}
+
+func TestCheckPath(t *testing.T) {
+	dir := createBrowserTree(t)
+	share := filepath.Join(dir, "share")
+
+	tests := []struct {
+		name    string
+		path    string
+		allowed string
+		code    string
+	}{
+		{ "allowed", share + "/a.txt", share, "" },
+		{ "allowed directory", share, share, "" },
+		{ "link within", share + "/inside", share, "" },
+		{ "allowed through link", dir + "/link/a.txt", dir + "/link", "" },
+
+		{ "outside", dir + "/outside/secret.txt", share, browser.ErrNotAllowed },
+		{ "traversal", share + "/../outside/secret.txt", share, browser.ErrNotAllowed },
+		{ "link to file outside", share + "/secret", share, browser.ErrNotAllowed },
+		{ "link to directory outside", share + "/escape", share, browser.ErrNotAllowed },
+		{ "through link outside", share + "/escape/secret.txt", share, browser.ErrNotAllowed },
+
+		// Paths that can't be resolved are rejected instead of skipping the second check
+		{ "missing", share + "/missing", share, browser.ErrNotFound },
+		{ "dangling link", share + "/dangling", share, browser.ErrNotFound },
+	}
+
+	for _, test := range tests {
+		_, err := browser.CheckPath(test.path, test.allowed)
+		areEqual(test.name, test.code, browserCode(err), t)
+	}
+
+	path, _ := browser.CheckPath(share + "/sub/../a.txt", share)
+	areEqual("cleaned", share + "/a.txt", path, t)
+}
+
+// Describes every entry in a tar.gz or zip archive as "name" for directories, "name -> target" for symlinks and
+// "name: contents" for regular files, separated by commas
+func describeArchive(t *testing.T, format string, data []byte) string {
+	var entries []string
+
+	describe := func(name string, mode os.FileMode, contents io.Reader) {
+		name = strings.TrimSuffix(name, "/")
+		read, err := ioutil.ReadAll(contents)
+		if err != nil {
+			t.Fatalf("Unable to read %s from archive: %s", name, err)
+		}
+
+		switch {
+		case mode.IsDir():
+			entries = append(entries, name)
+		case mode & os.ModeSymlink != 0:
+			entries = append(entries, name + " -> " + string(read))
+		default:
+			entries = append(entries, name + ": " + string(read))
+		}
+	}
+
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Unable to open zip archive: %s", err)
+		}
+
+		for _, f := range zr.File {
+			contents, err := f.Open()
+			if err != nil {
+				t.Fatalf("Unable to open %s: %s", f.Name, err)
+			}
+
+			describe(f.Name, f.Mode(), contents)
+			contents.Close()
+		}
+
+		return strings.Join(entries, ",")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unable to open tar.gz archive: %s", err)
+	}
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unable to read tar.gz archive: %s", err)
+		}
+
+		// Link targets are stored in the header instead of the contents of tar entries
+		if hdr.Typeflag == tar.TypeSymlink {
+			describe(hdr.Name, os.ModeSymlink, strings.NewReader(hdr.Linkname))
+		} else {
+			describe(hdr.Name, hdr.FileInfo().Mode(), tr)
+		}
+	}
+
+	return strings.Join(entries, ",")
+}
+
+func TestArchive(t *testing.T) {
+	dir := createBrowserTree(t)
+	share := filepath.Join(dir, "share")
+
+	// The FIFO is skipped and links are stored as links so nothing outside of the directory is included
+	expected := strings.Join([]string {
+		"share",
+		"share/a.txt: share/a.txt",
+		"share/dangling -> " + dir + "/missing",
+		"share/escape -> " + dir + "/outside",
+		"share/inside -> sub/b.txt",
+		"share/secret -> " + dir + "/outside/secret.txt",
+		"share/sub",
+		"share/sub/b.txt: share/sub/b.txt",
+	}, ",")
+
+	for _, format := range []string { "tar.gz", "zip" } {
+		var buf bytes.Buffer
+		if err := browser.WriteArchive(&buf, share, format); err != nil {
+			t.Fatalf("Unable to write %s archive: %s", format, err)
+		}
+
+		areEqual(format, expected, describeArchive(t, format, buf.Bytes()), t)
+	}
+
+	areEqual("unknown format", true, browser.WriteArchive(ioutil.Discard, share, "rar") != nil, t)
+}
+
+func TestArchiveLimits(t *testing.T) {
+	dir := createBrowserTree(t)
+	share := filepath.Join(dir, "share")
+
+	// The directory holds 9 entries (including itself) and the two regular files hold 26 bytes
+	tests := []struct {
+		name  string
+		files int
+		bytes int64
+		code  string
+	}{
+		{ "within limits", 9, 26, "" },
+		{ "too many files", 8, 26, browser.ErrTooLarge },
+		{ "too many bytes", 9, 25, browser.ErrTooLarge },
+	}
+
+	for _, test := range tests {
+		areEqual(test.name, test.code, browserCode(browser.CheckArchiveLimits(share, test.files, test.bytes)), t)
+	}
+
+	areEqual("missing", browser.ErrNotFound, browserCode(browser.CheckArchiveLimits(dir + "/missing", 9, 26)), t)
+}
+
+func TestDetectType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	oversized := append(bytes.Repeat([]byte("a"), 1024), 0, 1, 2)
+
+	tests := []struct {
+		name     string
+		file     string
+		data     []byte
+		expected string
+	}{
+		{ "text", "notes.txt", []byte("hello"), "text/plain; charset=utf-8" },
+		{ "text without extension", "README", []byte("hello"), "text/plain; charset=utf-8" },
+		{ "uppercase extension", "NOTES.TXT", []byte("hello"), "text/plain; charset=utf-8" },
+		{ "json", "data.json", []byte(`{ "a": 1 }`), "application/json" },
+		{ "html", "page.html", []byte("<html><body>hi</body></html>"), "text/html; charset=utf-8" },
+		{ "image", "photo.png", png, "image/png" },
+		{ "image with text extension", "photo.txt", png, "image/png" },
+		{ "binary", "data.bin", []byte { 0, 1, 2, 3 }, "application/octet-stream" },
+		{ "binary with text extension", "data.txt", []byte { 0, 1, 2, 3 }, "application/octet-stream" },
+		{ "empty", "empty.log", []byte{}, "text/plain; charset=utf-8" },
+
+		// Only the start of the file is sniffed
+		{ "oversized", "big.log", oversized, "text/plain; charset=utf-8" },
+	}
+
+	for _, test := range tests {
+		areEqual(test.name, test.expected, browser.DetectType(test.file, test.data), t)
+	}
+}
+
+func TestPreviewType(t *testing.T) {
+	tests := []struct {
+		name     string
+		detected string
+		expected string
+		ok       bool
+	}{
+		{ "text", "text/plain; charset=utf-8", "text/plain; charset=utf-8", true },
+		{ "html", "text/html; charset=utf-8", "text/plain; charset=utf-8", true },
+		{ "json", "application/json", "application/json", true },
+		{ "png", "image/png", "image/png", true },
+		{ "jpeg", "image/jpeg", "image/jpeg", true },
+		{ "svg", "image/svg+xml", "", false },
+		{ "pdf", "application/pdf", "", false },
+		{ "binary", "application/octet-stream", "", false },
+	}
+
+	for _, test := range tests {
+		mime, ok := api.PreviewType(test.detected)
+		areEqual(test.name, test.expected, mime, t)
+		areEqual(test.name + " allowed", test.ok, ok, t)
+	}
+}
+
+func TestReadPreview(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.log")
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("a"), 2048), 0644); err != nil {
+		t.Fatalf("Unable to create file: %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		size      int64
+		length    int
+		truncated bool
+	}{
+		{ "oversized", 1024, 1024, true },
+		{ "exact", 2048, 2048, false },
+		{ "whole file", 4096, 2048, false },
+	}
+
+	for _, test := range tests {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Unable to open file: %s", err)
+		}
+
+		info, _ := file.Stat()
+		msg, data, err := browser.ReadPreview(file, info, test.size)
+		file.Close()
+
+		if err != nil {
+			t.Errorf("Error testing %s - unable to read preview: %s", test.name, err)
+			continue
+		}
+
+		areEqual(test.name + " length", test.length, len(data), t)
+		areEqual(test.name + " truncated", test.truncated, msg.Truncated, t)
+		areEqual(test.name + " type", "text/plain; charset=utf-8", msg.MIME, t)
+		areEqual(test.name + " name", "big.log", msg.Name, t)
+	}
+}
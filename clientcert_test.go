@@ -0,0 +1,63 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestClientCertificateLogin(t *testing.T) {
+	router := api.NewRouter()
+	config.CreateUser("mtls-user", "", structs.RoleViewer, nil)
+	config.SetClientCertificate("CN=mtls-laptop", "mtls-user")
+	config.SetClientCertificate("CN=mtls-deleted", "mtls-nobody")
+
+	tests := []struct {
+		name     string
+		subject  string
+		verified bool
+		username string
+		status   int
+	}{
+		{ "mapped", "mtls-laptop", true, "", http.StatusOK },
+		{ "mapped with same username", "mtls-laptop", true, "mtls-user", http.StatusOK },
+		{ "mapped with other username", "mtls-laptop", true, "admin", http.StatusForbidden },
+		{ "unmapped", "mtls-desktop", true, "", http.StatusForbidden },
+		{ "unverified", "mtls-laptop", false, "", http.StatusForbidden },
+		{ "unknown user", "mtls-deleted", true, "", http.StatusForbidden },
+	}
+
+	for i, test := range tests {
+		cert := &x509.Certificate { Subject: pkix.Name { CommonName: test.subject } }
+
+		form := url.Values { "Username": { test.username } }
+		r := newRequest("POST", "/api/v0/authenticate", fmt.Sprintf("192.0.2.%d:1234", 50 + i), form, csrfHeaders())
+
+		// Certificates are only used if the handshake verified them against the client CA
+		r.TLS = &tls.ConnectionState { PeerCertificates: []*x509.Certificate { cert } }
+		if test.verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate { { cert } }
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		areEqual(test.name, test.status, w.Code, t)
+		if test.status == http.StatusOK {
+			areEqual(test.name + " response", "full", strings.TrimSpace(w.Body.String()), t)
+		}
+	}
+}
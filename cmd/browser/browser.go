@@ -16,16 +16,18 @@ package main
 import (
 	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"syscall"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
 
 	"github.com/spf13/viper"
 )
@@ -40,8 +42,18 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	flagPath     := flag.String("f", "", "Path to browse to")
+	flagArchive  := flag.String("a", "", "Stream the directory at path as an archive (tar.gz or zip)")
+	flagSearch   := flag.String("s", "", "Search the directory at path for names matching this glob or substring")
+	flagDepth    := flag.Int("d", 0, "Maximum depth to search")
+	flagResults  := flag.Int("n", 0, "Maximum number of search results")
+	flagBudget   := flag.Int("t", 0, "Maximum number of seconds to search for")
+	flagHistory  := flag.String("r", "", "Relative path to look for in every snapshot of the dataset at path")
+	flagPreview  := flag.Int64("p", 0, "Read at most this many bytes from the start of the file at path")
 	flag.Parse()
 	path := *flagPath
+	archive := *flagArchive
+	search := *flagSearch
+	history := *flagHistory
 
 	log.Printf("Initializing Lifeguard file browser")
 
@@ -66,25 +78,26 @@ func main() {
 	viper.SetConfigName("browser")
 	viper.AddConfigPath("./config/")
 
+	viper.SetDefault("browser.archive_max_files", 10000)
+	viper.SetDefault("browser.archive_max_size", 1 << 30)
+	viper.SetDefault("browser.search_max_depth", 32)
+	viper.SetDefault("browser.search_max_results", 1000)
+	viper.SetDefault("browser.search_max_time", 10)
+	viper.SetDefault("browser.preview_max_size", 1 << 20)
+
 	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Unable to load config: %s", err)
+		Fail(browser.ErrInternal, "Unable to load config: %s", err)
 	}
 
 	// Verify that file browsing is enabled and allowed for the given path
 	if !viper.GetBool("browser.enabled") {
-		log.Fatalf("File browser is disabled")
+		Fail(browser.ErrNotAllowed, "File browser is disabled")
 	}
 
-	all := viper.GetString("browser.allowed")
-	ok := false
-	for _, allowed := range strings.Split(all, ",") {
-		if strings.HasPrefix(path, allowed) {
-			ok = true
-			break
-		}
-	}
-	if !ok {
-		log.Fatalf("Path %s is not allowed", path)
+	allowed := viper.GetString("browser.allowed")
+	path, err := browser.CheckPath(path, allowed)
+	if err != nil {
+		Fail(ErrorCode(err), "Unable to browse to %s: %s", *flagPath, err)
 	}
 
 	log.Printf("Lifeguard file browser initialized")
@@ -92,51 +105,116 @@ func main() {
 	// Open and stat the path
 	file, openErr := os.Open(path)
 	if openErr != nil {
-		log.Fatalf("Error: unable to open %s: %s", path, openErr)
+		Fail(ErrorCode(openErr), "Unable to open %s: %s", path, openErr)
 	}
 	
 	info, statErr := file.Stat()
 	if statErr != nil {
-		log.Fatalf("Error: unable to stat %s: %s", path, statErr)
+		Fail(ErrorCode(statErr), "Unable to stat %s: %s", path, statErr)
 	}
 
-	// List the contents of the directory or read the file
-	if info.IsDir() {
+	// Archive or search the directory, list the contents of the directory or read (or preview) the file
+	if *flagPreview > 0 {
+		if !info.Mode().IsRegular() {
+			Fail(browser.ErrWrongType, "Only regular files can be previewed")
+		}
+
+		size := *flagPreview
+		if max := viper.GetInt64("browser.preview_max_size"); size > max {
+			size = max
+		}
+
+		SendPreview(file, info, size)
+
+	} else if search != "" || history != "" {
+		if !info.IsDir() {
+			Fail(browser.ErrWrongType, "Only directories can be searched")
+		}
+
+		if history != "" {
+			msg, err := browser.History(path, history, browser.ResolveAll(allowed))
+			if err != nil {
+				Fail(ErrorCode(err), "Unable to search the snapshots of %s: %s", path, err)
+			}
+
+			Send(msg)
+			return
+		}
+
+		limits := browser.SearchLimits {
+			Depth:   capLimit(*flagDepth, viper.GetInt("browser.search_max_depth")),
+			Results: capLimit(*flagResults, viper.GetInt("browser.search_max_results")),
+			Budget:  time.Duration(capLimit(*flagBudget, viper.GetInt("browser.search_max_time"))) * time.Second,
+		}
+
+		msg, err := browser.Search(path, search, limits)
+		if err != nil {
+			Fail(ErrorCode(err), "Unable to search %s: %s", path, err)
+		}
+
+		Send(msg)
+
+	} else if archive != "" {
+		if !info.IsDir() {
+			Fail(browser.ErrWrongType, "Only directories can be archived")
+		} else if archive != "tar.gz" && archive != "zip" {
+			Fail(browser.ErrInvalidArgument, "Unknown archive format %s", archive)
+		}
+
+		maxFiles := viper.GetInt("browser.archive_max_files")
+		if err := browser.CheckArchiveLimits(path, maxFiles, viper.GetInt64("browser.archive_max_size")); err != nil {
+			Fail(ErrorCode(err), "Unable to archive %s: %s", path, err)
+		}
+
+		SendPayload(browser.TypeArchive, filepath.Base(path), func(w io.Writer) error {
+			return browser.WriteArchive(w, path, archive)
+		})
+
+	} else if info.IsDir() {
 		contents, err := ioutil.ReadDir(path)
 		if err != nil {
-			log.Fatalf("Error: unable to list directory contents of %s: %s", path, err)
+			Fail(ErrorCode(err), "Unable to list directory contents of %s: %s", path, err)
+		}
+
+		msg := browser.Message {
+			Type:    browser.TypeListing,
+			Name:    path,
+			Entries: make([]browser.Entry, 0, len(contents)),
 		}
 
-		fmt.Printf("fold")
 		for _, entry := range contents {
-			typeChar := "f"
-			name := base64.StdEncoding.EncodeToString([]byte(entry.Name()))
+			msg.Entries = append(msg.Entries, browser.NewEntry(path, entry))
+		}
 
-			if entry.IsDir() {
-				typeChar = "d"
-			}
+		Send(msg)
 
-			// Output format: "type encoded_name bytes"
-			fmt.Printf("%s %s %d\n", typeChar, name, entry.Size())
-		}
 	} else {
-		fmt.Printf("file")
-		if _, err := io.Copy(os.Stdout, file); err != nil {
-			log.Fatalf("Error: Unable to copy %s: %s", path, err)
-		}
+		SendPayload(browser.TypeFile, filepath.Base(path), func(w io.Writer) error {
+			_, err := io.Copy(w, file)
+			return err
+		})
+	}
+}
+
+// Returns requested unless it is unset or larger than the configured maximum
+func capLimit(requested int, max int) int {
+	if requested <= 0 || requested > max {
+		return max
 	}
+
+	return requested
 }
 
 func AssertConfigPermissions() {
 	f, openErr := os.Open("config/browser.ini")
 	if openErr != nil {
-		log.Fatalf("Error: unable to open config: %s", openErr)
+		Fail(browser.ErrInternal, "Unable to open config: %s", openErr)
 	}
 	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		log.Fatalf("Error: unable to stat config: %s", err)
+		Fail(browser.ErrInternal, "Unable to stat config: %s", err)
 	}
 
 	uid := info.Sys().(*syscall.Stat_t).Uid
@@ -157,7 +235,7 @@ func AssertHashes() {
 	// Read the parent's executable to hash and verify it
 	f, err := os.Open("/proc/" + string(ppid) + "/exe")
 	if err != nil {
-		log.Fatalf("Error: unable to open parent process executable: %s", err)
+		Fail(browser.ErrInternal, "Unable to open parent process executable: %s", err)
 	}
 	defer f.Close()
 
@@ -165,13 +243,13 @@ func AssertHashes() {
 	sha512 := sha512.New()
 
 	if _, err := io.Copy(sha256, f); err != nil {
-		log.Fatalf("Error: unable to copy file to sha256 instance: %s", err)
+		Fail(browser.ErrInternal, "Unable to copy file to sha256 instance: %s", err)
 	}
 
 	f.Seek(0, 0)
 
 	if _, err := io.Copy(sha512, f); err != nil {
-		log.Fatalf("Error: unable to copy file to sha512 instance: %s", err)
+		Fail(browser.ErrInternal, "Unable to copy file to sha512 instance: %s", err)
 	}
 
 	calculated256 := fmt.Sprintf("%x", sha256.Sum(nil))
@@ -192,12 +270,9 @@ func AssertHashes() {
 }
 
 func ReportCheckFail(msg string) {
-	level := "Error"
-
 	if IsProduction {
-		log.Fatalf("%s: %s", level, msg)
-	} else {
-		level = "Warning"
-		log.Printf("%s: %s (would be fatal in production)", level, msg)
+		Fail(browser.ErrNotAllowed, "%s", msg)
 	}
+
+	log.Printf("Warning: %s (would be fatal in production)", msg)
 }
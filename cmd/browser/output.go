@@ -0,0 +1,76 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
+)
+
+// Reports an error to Lifeguard with the given code and exits
+func Fail(code string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("Error: %s", msg)
+
+	browser.WriteMessage(os.Stdout, browser.Message {
+		Type:  browser.TypeError,
+		Code:  code,
+		Error: msg,
+	})
+
+	os.Exit(1)
+}
+
+// Maps an error from the os or browser packages to the code reported to Lifeguard
+func ErrorCode(err error) string {
+	var browserErr *browser.Error
+
+	if errors.As(err, &browserErr) {
+		return browserErr.Code
+	} else if os.IsNotExist(err) {
+		return browser.ErrNotFound
+	} else if os.IsPermission(err) {
+		return browser.ErrPermissionDenied
+	}
+
+	return browser.ErrInternal
+}
+
+func Send(msg browser.Message) {
+	if err := browser.WriteMessage(os.Stdout, msg); err != nil {
+		log.Fatalf("Error: unable to write message: %s", err)
+	}
+}
+
+// Sends a message of the given type followed by everything that write writes as the payload. If writing fails part of
+// the way through, the terminating frame is never sent so Lifeguard knows that the payload is incomplete.
+func SendPayload(kind string, name string, write func(w io.Writer) error) {
+	Send(browser.Message {
+		Type: kind,
+		Name: name,
+	})
+
+	payload := browser.NewPayloadWriter(os.Stdout)
+
+	// Buffer writes so the payload isn't split into many tiny frames by the archive writers
+	buffered := bufio.NewWriterSize(payload, 64 * 1024)
+
+	if err := write(buffered); err != nil {
+		log.Fatalf("Error: unable to write %s payload: %s", kind, err)
+	}
+
+	if err := buffered.Flush(); err != nil {
+		log.Fatalf("Error: unable to flush %s payload: %s", kind, err)
+	}
+
+	if err := payload.Close(); err != nil {
+		log.Fatalf("Error: unable to finish %s payload: %s", kind, err)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
+)
+
+// Sends up to size bytes from the start of file along with the detected MIME type
+func SendPreview(file *os.File, info os.FileInfo, size int64) {
+	msg, data, err := browser.ReadPreview(file, info, size)
+	if err != nil {
+		Fail(ErrorCode(err), "Unable to read %s: %s", file.Name(), err)
+	}
+
+	Send(msg)
+
+	payload := browser.NewPayloadWriter(os.Stdout)
+	if _, err := payload.Write(data); err != nil {
+		Fail(browser.ErrInternal, "Unable to write preview: %s", err)
+	}
+
+	if err := payload.Close(); err != nil {
+		Fail(browser.ErrInternal, "Unable to finish preview: %s", err)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestCSRF(t *testing.T) {
+	router := api.NewRouter()
+	operator := newToken(t, "csrf-operator", structs.RoleOperator, structs.PermMaintain)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		status  int
+	}{
+		{ "missing", "POST", "/api/v0/logout", nil, http.StatusForbidden },
+		{ "cookie only", "POST", "/api/v0/logout", map[string]string { "Cookie": "CSRF=test" }, http.StatusForbidden },
+		{ "header only", "POST", "/api/v0/logout", map[string]string { "X-CSRF-Token": "test" }, http.StatusForbidden },
+		{ "empty", "POST", "/api/v0/logout", map[string]string { "Cookie": "CSRF=", "X-CSRF-Token": "" },
+			http.StatusForbidden },
+		{ "mismatch", "POST", "/api/v0/logout", map[string]string { "Cookie": "CSRF=test", "X-CSRF-Token": "other" },
+			http.StatusForbidden },
+		{ "match", "POST", "/api/v0/logout", csrfHeaders(), http.StatusOK },
+
+		// Reads aren't checked and neither are requests made with an API token, which browsers never send on their own
+		{ "get", "GET", "/api/v0/info", nil, http.StatusOK },
+		{ "token", "POST", "/api/v0/pool/missing/trim", map[string]string { "Authorization": operator }, http.StatusBadRequest },
+	}
+
+	for _, test := range tests {
+		w := serve(router, test.method, test.path, "192.0.2.40:1234", nil, test.headers)
+		areEqual(test.name, test.status, w.Code, t)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	router := api.NewRouter()
+
+	var info struct {
+		CSRFToken string
+	}
+
+	w := serve(router, "GET", "/api/v0/info", "192.0.2.40:1234", nil, nil)
+	json.NewDecoder(w.Body).Decode(&info)
+
+	var cookie string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "CSRF" {
+			cookie = c.Value
+		}
+	}
+
+	areEqual("token issued", true, info.CSRFToken != "", t)
+	areEqual("cookie matches", info.CSRFToken, cookie, t)
+
+	// An existing token is reused so that other open tabs keep working
+	w = serve(router, "GET", "/api/v0/info", "192.0.2.40:1234", nil, map[string]string { "Cookie": "CSRF=existing" })
+	json.NewDecoder(w.Body).Decode(&info)
+	areEqual("token reused", "existing", info.CSRFToken, t)
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
+)
+
+func TestExec(t *testing.T) {
+	stdout, stderr, err := zpool.Exec(context.Background(), []string { "sh", "-c", "echo out; echo err >&2" })
+	areEqual("stdout", "out\n", stdout, t)
+	areEqual("stderr", "err\n", stderr, t)
+	areEqual("error", nil, err, t)
+
+	stdout, err = zpool.ExecOutput(context.Background(), []string { "sh", "-c", "cat" })
+	areEqual("no input", "", stdout, t)
+	areEqual("no input error", nil, err, t)
+
+	stdout, _, err = zpool.ExecWithInput(context.Background(), []string { "cat" }, []byte("passphrase"))
+	areEqual("input", "passphrase", stdout, t)
+	areEqual("input error", nil, err, t)
+}
+
+func TestExecError(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  []string
+		exitCode int
+		stderr   string
+		notFound bool
+	}{
+		{ "exit code", []string { "sh", "-c", "echo ' boom ' >&2; exit 3" }, 3, "boom", false },
+		{ "missing pool", []string { "sh", "-c", "echo \"cannot open 'tank': no such pool\" >&2; exit 1" }, 1,
+			"cannot open 'tank': no such pool", true },
+		{ "missing dataset", []string { "sh", "-c", "echo \"cannot open 'tank/a': dataset does not exist\" >&2; exit 1" },
+			1, "cannot open 'tank/a': dataset does not exist", true },
+		{ "missing command", []string { "/nonexistent/lifeguard-test" }, -1, "", false },
+	}
+
+	for _, test := range tests {
+		_, _, err := zpool.Exec(context.Background(), test.command)
+
+		var execErr *zpool.ExecError
+		if !errors.As(err, &execErr) {
+			t.Errorf("Error testing %s - expected *ExecError, was %#v", test.name, err)
+			continue
+		}
+
+		areEqual(test.name + " exit code", test.exitCode, execErr.ExitCode, t)
+		areEqual(test.name + " stderr", test.stderr, execErr.Stderr, t)
+		areEqual(test.name + " not found", test.notFound, errors.Is(err, zpool.ErrNotFound), t)
+		areEqual(test.name + " command", true, strings.HasPrefix(err.Error(), strings.Join(test.command, " ") + ": "), t)
+	}
+
+	// The underlying error is kept when there is nothing more specific
+	_, _, err := zpool.Exec(context.Background(), []string { "false" })
+	var exitErr *exec.ExitError
+	areEqual("exit error", true, errors.As(err, &exitErr), t)
+}
+
+func TestExecTimeout(t *testing.T) {
+	config.Set("timeout.value", "1")
+	defer config.Set("timeout.value", "4")
+
+	start := time.Now()
+	_, _, err := zpool.Exec(context.Background(), []string { "sleep", "10" })
+
+	areEqual("timed out", true, errors.Is(err, zpool.ErrTimeout), t)
+	areEqual("killed", true, time.Since(start) < 5 * time.Second, t)
+
+	var execErr *zpool.ExecError
+	if errors.As(err, &execErr) {
+		areEqual("exit code", -1, execErr.ExitCode, t)
+	}
+
+	// Invalid timeouts fall back to the default instead of never timing out
+	config.Set("timeout.value", "0")
+	_, _, err = zpool.Exec(context.Background(), []string { "true" })
+	areEqual("invalid timeout", nil, err, t)
+}
+
+func TestExecCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100 * time.Millisecond, cancel)
+
+	start := time.Now()
+	_, _, err := zpool.Exec(ctx, []string { "sleep", "10" })
+
+	areEqual("cancelled", true, errors.Is(err, context.Canceled), t)
+	areEqual("not a timeout", false, errors.Is(err, zpool.ErrTimeout), t)
+	areEqual("killed", true, time.Since(start) < 5 * time.Second, t)
+}
+
+func TestExecStream(t *testing.T) {
+	var output string
+	_, err := zpool.ExecStream(context.Background(), []string { "sh", "-c", "echo streamed" }, func(stdout io.Reader) error {
+		data, err := ioutil.ReadAll(stdout)
+		output = string(data)
+		return err
+	})
+
+	areEqual("output", "streamed\n", output, t)
+	areEqual("error", nil, err, t)
+
+	// A failing handler stops the command and its error is returned
+	handlerErr := errors.New("client went away")
+	start := time.Now()
+
+	_, err = zpool.ExecStream(context.Background(), []string { "sh", "-c", "echo start; sleep 10" }, func(stdout io.Reader) error {
+		return handlerErr
+	})
+
+	areEqual("handler error", handlerErr, err, t)
+	areEqual("stopped", true, time.Since(start) < 5 * time.Second, t)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	passing := func(ctx context.Context) error { return nil }
+	failing := func(ctx context.Context) error { return errors.New("unable to open /secret/path") }
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		checks map[string]func(ctx context.Context) error
+		status int
+		report string
+	}{
+		{ "liveness", "GET", "/healthz", nil, http.StatusOK, "ok" },
+		{ "liveness head", "HEAD", "/healthz", nil, http.StatusOK, "" },
+		{ "liveness ignores checks", "GET", "/healthz", map[string]func(ctx context.Context) error { "database": failing },
+			http.StatusOK, "ok" },
+		{ "ready", "GET", "/readyz", map[string]func(ctx context.Context) error { "database": passing, "zfs": passing },
+			http.StatusOK, "ok" },
+		{ "database down", "GET", "/readyz", map[string]func(ctx context.Context) error { "database": failing, "zfs": passing },
+			http.StatusServiceUnavailable, "fail" },
+		{ "zfs down", "GET", "/readyz", map[string]func(ctx context.Context) error { "database": passing, "zfs": failing },
+			http.StatusServiceUnavailable, "fail" },
+		{ "readiness head", "HEAD", "/readyz", map[string]func(ctx context.Context) error { "zfs": failing },
+			http.StatusServiceUnavailable, "" },
+	}
+
+	original := api.ReadinessChecks
+	defer func() { api.ReadinessChecks = original }()
+
+	router := api.NewRouter()
+
+	for _, test := range tests {
+		api.ReadinessChecks = test.checks
+
+		// No session cookie or API token is sent
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		areEqual(test.name + " status", test.status, w.Code, t)
+		if test.report == "" {
+			continue
+		}
+
+		// The reason a check failed is only logged
+		body := w.Body.String()
+		areEqual(test.name + " error hidden", false, strings.Contains(body, "secret"), t)
+
+		var report api.HealthReport
+		if err := json.Unmarshal([]byte(body), &report); err != nil {
+			t.Errorf("Error testing %s - unable to decode report: %s", test.name, err)
+			continue
+		}
+
+		areEqual(test.name + " report", test.report, report.Status, t)
+		if test.path == "/readyz" {
+			areEqual(test.name + " checks", len(test.checks), len(report.Checks), t)
+		}
+	}
+}
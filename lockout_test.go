@@ -0,0 +1,94 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func attemptLogin(router http.Handler, username string, password string, remote string) *http.Response {
+	form := url.Values { "Username": { username }, "Password": { password } }
+	return serve(router, "POST", "/api/v0/authenticate", remote, form, csrfHeaders()).Result()
+}
+
+// Returns the number of failures recorded for the user or IP with the given kind and key, or -1 if there are none
+func lockoutFailures(t *testing.T, router http.Handler, admin string, kind string, key string) int {
+	var lockouts []api.Lockout
+
+	w := serve(router, "GET", "/api/v0/lockouts", "192.0.2.99:1234", nil, map[string]string { "Cookie": admin })
+	if err := json.NewDecoder(w.Body).Decode(&lockouts); err != nil {
+		t.Fatalf("Unable to decode lockouts: %s", err)
+	}
+
+	for _, lockout := range lockouts {
+		if lockout.Kind == kind && lockout.Key == key {
+			return lockout.Failures
+		}
+	}
+
+	return -1
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	router := api.NewRouter()
+	admin := adminSession(t, router, "lockout-admin")
+	config.CreateUser("lockout-user", crypto.HashPassword("password"), structs.RoleViewer, nil)
+
+	// The first few failures are allowed immediately
+	for i := 0; i < 3; i++ {
+		res := attemptLogin(router, "lockout-user", "wrong", "192.0.2.10:1234")
+		areEqual("failure", http.StatusForbidden, res.StatusCode, t)
+	}
+
+	res := attemptLogin(router, "lockout-user", "password", "192.0.2.10:1234")
+	areEqual("backoff", http.StatusTooManyRequests, res.StatusCode, t)
+	areEqual("retry after", true, res.Header.Get("Retry-After") != "", t)
+
+	// The username is limited from every address, and the address is limited for every username
+	res = attemptLogin(router, "lockout-user", "password", "192.0.2.11:1234")
+	areEqual("user backoff from another address", http.StatusTooManyRequests, res.StatusCode, t)
+
+	res = attemptLogin(router, "lockout-other", "password", "192.0.2.10:1234")
+	areEqual("address backoff for another user", http.StatusTooManyRequests, res.StatusCode, t)
+
+	areEqual("user failures", 3, lockoutFailures(t, router, admin, "user", "lockout-user"), t)
+	areEqual("address failures", 3, lockoutFailures(t, router, admin, "ip", "192.0.2.10"), t)
+
+	// Unlocking the user still leaves the address limited
+	unlock := url.Values { "Kind": { "user" }, "Key": { "lockout-user" } }
+	w := serve(router, "POST", "/api/v0/lockouts/unlock", "192.0.2.99:1234", unlock, csrfHeaders(admin))
+	areEqual("unlock", http.StatusOK, w.Code, t)
+
+	res = attemptLogin(router, "lockout-user", "password", "192.0.2.10:1234")
+	areEqual("address still limited", http.StatusTooManyRequests, res.StatusCode, t)
+
+	res = attemptLogin(router, "lockout-user", "password", "192.0.2.11:1234")
+	areEqual("unlocked user", http.StatusOK, res.StatusCode, t)
+}
+
+// Logging in successfully only clears the failures of that user, otherwise an attacker could reset the limit on their
+// address by logging in to an account they control between guesses
+func TestLockoutSuccess(t *testing.T) {
+	router := api.NewRouter()
+	admin := adminSession(t, router, "lockout-admin")
+	config.CreateUser("lockout-attacker", crypto.HashPassword("password"), structs.RoleViewer, nil)
+
+	attemptLogin(router, "lockout-victim", "guess", "192.0.2.20:1234")
+	attemptLogin(router, "lockout-attacker", "wrong", "192.0.2.20:1234")
+
+	res := attemptLogin(router, "lockout-attacker", "password", "192.0.2.20:1234")
+	areEqual("login", http.StatusOK, res.StatusCode, t)
+
+	areEqual("user failures cleared", -1, lockoutFailures(t, router, admin, "user", "lockout-attacker"), t)
+	areEqual("other user's failures kept", 1, lockoutFailures(t, router, admin, "user", "lockout-victim"), t)
+	areEqual("address failures kept", 2, lockoutFailures(t, router, admin, "ip", "192.0.2.20"), t)
+}
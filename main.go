@@ -9,10 +9,12 @@ import (
 	"log"
 	"syscall"
 	"os"
+	"strings"
 
 	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -22,11 +24,18 @@ func main() {
 	resetFlag  := flag.String("r", "", "Username to reset password for")
 	createFlag := flag.String("c", "", "Username to create")
 	tfaFlag    := flag.String("t", "", "Username to remove 2FA for")
+	modifyFlag := flag.String("m", "", "Username to change the role of (set with -role)")
+	roleFlag   := flag.String("role", structs.RoleViewer, "Role for created or modified users (viewer, operator or admin)")
+	scopeFlag  := flag.String("s", "", "Username to limit to the pools and datasets set with -scope")
+	scopesFlag := flag.String("scope", "", "Comma separated pools and datasets (leave empty to remove all limits)")
 	flag.Parse()
 	config.DevMode = *devFlag
 	reset := *resetFlag
 	create := *createFlag
 	tfa := *tfaFlag
+	modify := *modifyFlag
+	role := *roleFlag
+	scope := *scopeFlag
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -44,10 +53,14 @@ func main() {
 
 	// Command line operations should only be available to root
 	prompt := reset != "" || create != ""
-	if (prompt || tfa != "") && os.Geteuid() != 0 {
+	if (prompt || tfa != "" || modify != "" || scope != "") && os.Geteuid() != 0 {
 		log.Fatalf("CLI is only available to root")
 	}
 
+	if !structs.IsRole(role) {
+		log.Fatalf("Unknown role %s", role)
+	}
+
 	hash := ""
 	if prompt {
 		fmt.Print("Enter new password: ")
@@ -62,19 +75,51 @@ func main() {
 	}
 
 	if reset != "" {
-		config.SetPassword(reset, hash)
+		if err := config.SetPassword(reset, hash); err != nil {
+			log.Fatalf("Unable to reset password for %s: %s", reset, err)
+		}
+
+		// Anyone who was logged in with the old password is logged out
+		if err := config.RevokeSessions(reset, ""); err != nil {
+			log.Fatalf("Unable to revoke sessions for %s: %s", reset, err)
+		}
 		log.Printf("Successfully reset password for %s", reset)
 		return
 
 	} else if create != "" {
-		config.CreateUser(create, hash, nil)
-		log.Printf("Successfully created account for %s", create)
+		if err := config.CreateUser(create, hash, role, nil); err != nil {
+			log.Fatalf("Unable to create account for %s: %s", create, err)
+		}
+		log.Printf("Successfully created account for %s with role %s", create, role)
 		return
 
 	} else if tfa != "" {
-		config.DisableTwoFactor(tfa)
+		if err := config.DisableTwoFactor(tfa); err != nil {
+			log.Fatalf("Unable to disable two factor for %s: %s", tfa, err)
+		}
 		log.Printf("Successfully disabled two factor for %s", tfa)
 		return
+
+	} else if modify != "" {
+		if err := config.SetRole(modify, role); err != nil {
+			log.Fatalf("Unable to change role of %s: %s", modify, err)
+		}
+		log.Printf("Successfully changed role of %s to %s", modify, role)
+		return
+
+	} else if scope != "" {
+		var scopes []string
+		for _, object := range strings.Split(*scopesFlag, ",") {
+			if object = strings.Trim(object, " /"); object != "" {
+				scopes = append(scopes, object)
+			}
+		}
+
+		if err := config.SetScopes(scope, scopes); err != nil {
+			log.Fatalf("Unable to limit %s: %s", scope, err)
+		}
+		log.Printf("Successfully limited %s to %v (empty is unrestricted)", scope, scopes)
+		return
 	}
 
 	api.Setup()
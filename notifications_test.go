@@ -0,0 +1,58 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/notifications"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestNotificationScopes(t *testing.T) {
+	router := api.NewRouter()
+
+	notifications.UpdatePoolState("notify-tank", &structs.Pool { State: "DEGRADED" }, &structs.Pool { State: "ONLINE" })
+	notifications.UpdatePoolState("notify-backup", &structs.Pool { State: "DEGRADED" }, &structs.Pool { State: "ONLINE" })
+	notifications.SendNotification(6, "warning", "Account \"notify-user\" locked")
+
+	unrestricted := newToken(t, "notify-unrestricted", structs.RoleViewer, structs.PermView)
+	scoped := newToken(t, "notify-scoped", structs.RoleViewer, structs.PermView)
+	config.SetScopes("notify-scoped", []string { "notify-tank/team" })
+
+	tests := []struct {
+		name     string
+		auth     string
+		expected []string
+	}{
+		{ "unrestricted", unrestricted, []string { "notify-tank", "notify-backup", "" } },
+		{ "scoped", scoped, []string { "notify-tank" } },
+	}
+
+	for _, test := range tests {
+		var list []structs.Notification
+
+		w := serve(router, "GET", "/api/v0/notifications/list", "192.0.2.70:1234", nil,
+			map[string]string { "Authorization": test.auth })
+		areEqual(test.name + " status", http.StatusOK, w.Code, t)
+		json.NewDecoder(w.Body).Decode(&list)
+
+		// Other tests can send notifications too, so only the ones sent here are compared
+		var pools []string
+		for _, n := range list {
+			if n.Pool == "notify-tank" || n.Pool == "notify-backup" || n.Message == "Account \"notify-user\" locked" {
+				pools = append(pools, n.Pool)
+			}
+		}
+
+		areEqual(test.name, len(test.expected), len(pools), t)
+		for i := 0; i < len(pools) && i < len(test.expected); i++ {
+			areEqual(test.name + " pool", test.expected[i], pools[i], t)
+		}
+	}
+}
@@ -4,9 +4,14 @@
 package main
 
 import (
+	"io/ioutil"
+	"log"
 	"testing"
 	"os"
+	"path/filepath"
 
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
 
@@ -36,7 +41,24 @@ func areContainersEqual(name string, expected []*structs.Container, actual []*st
 
 func TestMain(m *testing.M) {
 	zpool.IsTest = true
-	os.Exit(m.Run())
+
+	// Tests that need the database share a temporary one so that the real configuration is never touched
+	dir, err := ioutil.TempDir("", "lifeguard-test")
+	if err != nil {
+		log.Fatalf("Unable to create test directory: %s", err)
+	}
+
+	config.LoadDatabase(filepath.Join(dir, "config.db"))
+
+	if err := api.LoadSessionStore(false); err != nil {
+		log.Fatalf("Unable to load session store: %s", err)
+	}
+
+	code := m.Run()
+
+	config.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
 }
 
 func TestHealthy(t *testing.T) {
@@ -0,0 +1,147 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	// Longest excerpt of a command's stderr that is saved
+	maxAuditStderr = 1024
+
+	// Number of entries returned by the query endpoint if no limit is given, and the most that can be requested
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Parameters whose values are never saved in the audit log. Names are compared case insensitively.
+var redactedParameters = []string { "password", "current", "passphrase", "code", "secret", "signature" }
+
+func SetupAudit(r *mux.Router) {
+	r.HandleFunc("/api/v0/audit", requireAdmin(queryAuditHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/audit/export", requireAdmin(exportAuditHandler)).Methods("GET")
+}
+
+// Records an action taken by the user that made the request. All URL and form parameters are saved except for
+// those that contain secrets.
+func audit(r *http.Request, action string, target string, ok bool, stderr string) {
+	auditAs(r, getUsernameQuiet(r), action, target, ok, stderr)
+}
+
+// Records an action on behalf of username, which is needed before the user has a session (such as when logging in)
+func auditAs(r *http.Request, username string, action string, target string, ok bool, stderr string) {
+	result := auditSuccess
+	if !ok {
+		result = auditFailure
+	}
+
+	if len(stderr) > maxAuditStderr {
+		stderr = stderr[:maxAuditStderr]
+	}
+
+	err := config.AddAuditEntry(structs.AuditEntry {
+		Time:       time.Now().Unix(),
+		Username:   username,
+		IP:         clientIP(r),
+		Action:     action,
+		Target:     target,
+		Parameters: auditParameters(r),
+		Result:     result,
+		Stderr:     strings.TrimSpace(stderr),
+	})
+
+	// The action has already happened so the audit entry is only logged instead of failing the request
+	if err != nil {
+		log.Printf("Unable to audit %s %s by %s (%s): %s", action, target, username, result, err)
+	}
+}
+
+func auditParameters(r *http.Request) map[string]string {
+	params := make(map[string]string)
+
+	for name, value := range mux.Vars(r) {
+		params[name] = value
+	}
+
+	r.ParseForm()
+	for name, values := range r.Form {
+		params[name] = strings.Join(values, ",")
+	}
+
+	for name := range params {
+		for _, redacted := range redactedParameters {
+			if strings.EqualFold(name, redacted) {
+				params[name] = "[redacted]"
+			}
+		}
+	}
+
+	return params
+}
+
+func getAuditFilter(r *http.Request, limit int) structs.AuditFilter {
+	filter := structs.AuditFilter {
+		Username: r.URL.Query().Get("user"),
+		Action:   r.URL.Query().Get("action"),
+		Target:   r.URL.Query().Get("target"),
+		Result:   r.URL.Query().Get("result"),
+		Limit:    limit,
+	}
+
+	filter.Since, _ = strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	filter.Until, _ = strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+
+	return filter
+}
+
+func queryAuditHandler(w http.ResponseWriter, r *http.Request) {
+	limit := atoiDefault(r.URL.Query().Get("limit"))
+	if limit == 0 {
+		limit = defaultAuditLimit
+	} else if limit < 0 || limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	entries, err := config.GetAuditEntries(getAuditFilter(r, limit))
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, entries)
+}
+
+// Sends every matching entry as JSON lines (one JSON object per line)
+func exportAuditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := config.GetAuditEntries(getAuditFilter(r, atoiDefault(r.URL.Query().Get("limit"))))
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"lifeguard-audit.jsonl\"")
+
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("Unable to export audit log: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
+)
+
+// Runs the browser helper with the provided arguments and passes the first message it sends to handler, along with
+// a reader for the payload that follows file and archive messages.
+func runBrowser(ctx context.Context, args []string, handler func(msg *browser.Message, payload io.Reader) error) error {
+	// TODO: Lifeguard could verify that the browser binary has a signature on it
+	// The signature can be from any key but the public key must be printed at startup
+	//    and must be the same between all binaries
+	cmd := append([]string { "./browser" }, args...)
+
+	stderr, err := zpool.ExecStream(ctx, cmd, func(stdout io.Reader) error {
+		msg, err := browser.ReadMessage(stdout)
+		if err != nil {
+			return err
+		}
+
+		return handler(msg, browser.NewPayloadReader(stdout))
+	})
+
+	if err != nil {
+		log.Printf("Browser failed with arguments %v: %s. Error: %s", args, err, stderr)
+	}
+
+	return err
+}
+
+// Removes the server's write timeout for this response. Downloads and archives can take much longer than the timeout
+// to send and would otherwise be cut off.
+func removeWriteDeadline(w http.ResponseWriter) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Unable to remove write deadline: %s", err)
+	}
+}
+
+// Maps an error from runBrowser to an HTTP response. If the response had already started when the error occurred,
+// the connection is aborted so the client doesn't mistake the truncated response for a complete one.
+func reportBrowserError(w http.ResponseWriter, err error, started bool) {
+	if started {
+		panic(http.ErrAbortHandler)
+	}
+
+	var browserErr *browser.Error
+	if !errors.As(err, &browserErr) {
+		http.Error(w, msgErrorOccurred, http.StatusInternalServerError)
+		return
+	}
+
+	switch browserErr.Code {
+	case browser.ErrNotAllowed:
+		http.Error(w, "Browsing this path is not allowed", http.StatusForbidden)
+
+	case browser.ErrNotFound:
+		http.Error(w, "No such file or directory", http.StatusNotFound)
+
+	case browser.ErrPermissionDenied:
+		http.Error(w, "Permission denied", http.StatusForbidden)
+
+	case browser.ErrTooLarge:
+		http.Error(w, "Too large to download", http.StatusRequestEntityTooLarge)
+
+	case browser.ErrInvalidArgument:
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+
+	case browser.ErrWrongType:
+		http.Error(w, "Not supported for this type of file", http.StatusUnsupportedMediaType)
+
+	default:
+		http.Error(w, msgErrorOccurred, http.StatusInternalServerError)
+	}
+}
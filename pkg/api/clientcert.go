@@ -0,0 +1,140 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+
+	"github.com/gorilla/mux"
+)
+
+// Client certificate modes. With "accept", clients without a certificate can still log in with a password.
+const (
+	clientAuthOff     = "off"
+	clientAuthAccept  = "accept"
+	clientAuthRequire = "require"
+)
+
+func SetupClientCertificates(r *mux.Router) {
+	r.HandleFunc("/api/v0/certificates", requireAdmin(listClientCertificatesHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/certificates", requireAdmin(addClientCertificateHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/certificates/delete", requireAdmin(deleteClientCertificateHandler)).Methods("POST")
+}
+
+// Configures tlsConfig to request client certificates signed by the CA in tls.client_ca
+func setupClientAuth(tlsConfig *tls.Config) {
+	mode := config.GetString("tls.client_auth", clientAuthOff)
+
+	switch mode {
+	case clientAuthOff:
+		return
+	case clientAuthAccept:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		log.Fatalf("Invalid value %s for tls.client_auth (must be off, accept or require)", mode)
+	}
+
+	path := config.GetString("tls.client_ca", "./config/client_ca.crt")
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Unable to read client CA: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		log.Fatalf("Unable to parse client CA %s", path)
+	}
+
+	tlsConfig.ClientCAs = pool
+
+	log.Printf("Client certificates signed by %s are %sed", path, mode)
+}
+
+// Returns the subject of the verified client certificate that the request was made with
+func getClientSubject(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.String(), true
+}
+
+// Returns the user that the request's client certificate is mapped to. Certificates are only used if they were
+// verified against the client CA during the handshake.
+func getClientCertificateUser(r *http.Request) (string, bool) {
+	subject, ok := getClientSubject(r)
+	if !ok {
+		return "", false
+	}
+
+	username, ok := config.GetClientCertificateUser(subject)
+	if !ok || !config.IsUser(username) {
+		log.Printf("%s presented client certificate %s which isn't mapped to a user", clientIP(r), subject)
+		return "", false
+	}
+
+	return username, true
+}
+
+func listClientCertificatesHandler(w http.ResponseWriter, r *http.Request) {
+	certs, err := config.GetClientCertificates()
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, certs)
+}
+
+func addClientCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	subject, okSubject := GetParameter(r, "Subject")
+	username, okUsername := GetParameter(r, "Username")
+	if !okSubject || !okUsername || subject == "" {
+		ReportMissing(w)
+		return
+	}
+
+	if !config.IsUser(username) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+
+	if err := config.SetClientCertificate(subject, username); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "add-client-certificate", username, true, "")
+	log.Printf("%s mapped client certificate %s to %s", getUsernameQuiet(r), subject, username)
+	http.Error(w, "OK", http.StatusOK)
+}
+
+func deleteClientCertificateHandler(w http.ResponseWriter, r *http.Request) {
+	subject, ok := GetParameter(r, "Subject")
+	if !ok {
+		ReportMissing(w)
+		return
+	}
+
+	if ok, err := config.DeleteClientCertificate(subject); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, "Unknown certificate", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "delete-client-certificate", subject, true, "")
+	log.Printf("%s removed client certificate %s", getUsernameQuiet(r), subject)
+	http.Error(w, "OK", http.StatusOK)
+}
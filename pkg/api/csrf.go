@@ -0,0 +1,74 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+)
+
+// CSRF protection uses the double submit pattern: a random token is stored in a cookie and must also be sent in a
+// header with every state changing request. Other sites can make the browser send the cookie but can't read the
+// token, which is only delivered to the web UI through /api/v0/info.
+const (
+	csrfCookie = "CSRF"
+	csrfHeader = "X-CSRF-Token"
+)
+
+// Rejects state changing requests that don't include a matching CSRF token. Requests authenticated with an API token
+// are exempt since browsers never add the Authorization header on their own, as are requests over the Unix socket
+// which browsers can't connect to.
+func csrfMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, ok := getRequestToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, ok := getPeerUID(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookie)
+		header := r.Header.Get(csrfHeader)
+
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			log.Printf("%s cannot access %s: missing or invalid CSRF token", clientIP(r), r.URL)
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Returns the CSRF token from the request's cookie, creating a new token if there isn't one
+func getCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+
+	token := crypto.GetRandom(32)
+
+	http.SetCookie(w, &http.Cookie {
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     store.Options.Path,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   store.Options.Secure || requestScheme(r) == "https",
+	})
+
+	return token
+}
@@ -4,13 +4,15 @@
 package api
 
 import (
-	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
-	"path/filepath"
 
+	"github.com/ConfusedPolarBear/lifeguard/pkg/browser"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
@@ -19,33 +21,48 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// See browser.Entry for the possible types. The first file in a listing has type "@" and is the directory itself.
 type File struct {
-	Type string
-	Name string
-	HMAC string
-	Size string
+	Type        string
+	Name        string
+	HMAC        string
+	Size        string
+	Modified    int64
+	Mode        string
+	Permissions string
+	Owner       string
+	Group       string
+	Target      string
 }
 
 func SetupDataset(r *mux.Router) {
 	// Retrieves information for a dataset or snapshot
-	r.HandleFunc("/api/v0/data/{id}/info", getDataInfoHandler).Methods("GET")
-	r.HandleFunc("/api/v0/data/{id}/mount", mountHandler).Methods("POST")
-	r.HandleFunc("/api/v0/data/{id}/unmount", unmountHandler).Methods("POST")
+	r.HandleFunc("/api/v0/data/{id}/info", requirePermission(structs.PermView, getDataInfoHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/data/{id}/mount", requirePermission(structs.PermMount, mountHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/data/{id}/unmount", requirePermission(structs.PermMount, unmountHandler)).Methods("POST")
 
 	// Load and unload encryption keys
-	r.HandleFunc("/api/v0/key/{id}/load", loadKeyHandler).Methods("POST")
-	r.HandleFunc("/api/v0/key/{id}/unload", unloadKeyHandler).Methods("POST")
+	r.HandleFunc("/api/v0/key/{id}/load", requirePermission(structs.PermKeys, loadKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/key/{id}/unload", requirePermission(structs.PermKeys, unloadKeyHandler)).Methods("POST")
 
 	// Start or pause a pool scrub
-	r.HandleFunc("/api/v0/pool/{id}/scrub/start", scrubHandler).Methods("POST")
-	r.HandleFunc("/api/v0/pool/{id}/scrub/pause", scrubPauseHandler).Methods("POST")
+	r.HandleFunc("/api/v0/pool/{id}/scrub/start", requirePermission(structs.PermMaintain, scrubHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/pool/{id}/scrub/pause", requirePermission(structs.PermMaintain, scrubPauseHandler)).Methods("POST")
 
 	// Trim and iostat
-	r.HandleFunc("/api/v0/pool/{id}/trim", trimHandler).Methods("POST")
-	r.HandleFunc("/api/v0/pool/{id}/iostat", iostatHandler).Methods("GET")
+	r.HandleFunc("/api/v0/pool/{id}/trim", requirePermission(structs.PermMaintain, trimHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/pool/{id}/iostat", requirePermission(structs.PermView, iostatHandler)).Methods("GET")
 
 	// File browsing
-	r.HandleFunc("/api/v0/files/browse/{id}", browseFilesHandler).Methods("GET")		// list directory
+	browse := func(handler http.HandlerFunc) http.HandlerFunc {
+		return requirePermission(structs.PermBrowse, handler)
+	}
+
+	r.HandleFunc("/api/v0/files/browse/{id}", browse(browseFilesHandler)).Methods("GET")		// list directory
+	r.HandleFunc("/api/v0/files/archive/{id}", browse(archiveFilesHandler)).Methods("GET")		// download directory
+	r.HandleFunc("/api/v0/files/search/{id}", browse(searchFilesHandler)).Methods("GET")		// search by name
+	r.HandleFunc("/api/v0/files/history/{id}", browse(fileHistoryHandler)).Methods("GET")		// find a path in every snapshot
+	r.HandleFunc("/api/v0/files/preview/{id}", browse(previewFileHandler)).Methods("GET")		// view the start of a file
 }
 
 func getDataInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -61,12 +78,23 @@ func getDataInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	dataType, errType := zpool.GetObjectProperties(r.Context(), name, "zfs", "type")
+	properties, errProps := zpool.GetObjectProperties(r.Context(), name, "zfs", config.GetString("properties.dataset", structs.DefaultProperties["dataset"]))
+	internal, errInternal := zpool.GetObjectProperties(r.Context(), name, "zfs", "keylocation")
+
+	for _, err := range []error { errType, errProps, errInternal } {
+		if err != nil {
+			ReportCommandError(w, err)
+			return
+		}
+	}
+
 	// Grab the keylocation so the load key button can be conditionally enabled
 	saved = &structs.Data {
 		Name:       name,
-		Type:       zpool.GetProperties(name, "zfs", "", "type")[0]["type"].Value,
-		Properties: zpool.GetProperties(name, "zfs", "", config.GetString("properties.dataset", structs.DefaultProperties["dataset"]))[0],
-		Internal:   zpool.GetProperties(name, "zfs", "", "keylocation")[0],
+		Type:       dataType["type"].Value,
+		Properties: properties,
+		Internal:   internal,
 	}
 
 	EncodeAndSend(w, saved)
@@ -86,7 +114,9 @@ func loadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.LoadKey(name, passphrase); err != nil {
+	if stderr, err := zpool.LoadKey(r.Context(), name, passphrase); err != nil {
+		audit(r, "load-key", name, false, stderr)
+
 		// TODO: unit test the first two conditions
 		if strings.Index(stderr, "Incorrect key provided") != -1 {
 			http.Error(w, "Incorrect passphrase", http.StatusUnauthorized)
@@ -102,6 +132,7 @@ func loadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit(r, "load-key", name, true, "")
 	log.Println(fmt.Sprintf("%s loaded key for %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -118,7 +149,9 @@ func unloadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.UnloadKey(name); err != nil {
+	if stderr, err := zpool.UnloadKey(r.Context(), name); err != nil {
+		audit(r, "unload-key", name, false, stderr)
+
 		if strings.Index(stderr, "is busy") != -1 {
 			http.Error(w, "Dataset is mounted", http.StatusBadRequest)
 
@@ -130,6 +163,7 @@ func unloadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit(r, "unload-key", name, true, "")
 	log.Println(fmt.Sprintf("%s unloaded key for %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -146,13 +180,16 @@ func scrubHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.Scrub(name); err != nil {
+	if stderr, err := zpool.Scrub(r.Context(), name); err != nil {
+		audit(r, "scrub-start", name, false, stderr)
+
 		log.Printf("Unable to scrub pool %s: %s. %s", name, err, stderr)
 		http.Error(w, stderr, http.StatusBadRequest)
 
 		return
 	}
 
+	audit(r, "scrub-start", name, true, "")
 	log.Println(fmt.Sprintf("%s started scrub for pool %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -170,13 +207,16 @@ func scrubPauseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.PauseScrub(name); err != nil {
+	if stderr, err := zpool.PauseScrub(r.Context(), name); err != nil {
+		audit(r, "scrub-pause", name, false, stderr)
+
 		log.Printf("Unable to pause scrubbing pool %s: %s. %s", name, err, stderr)
 		http.Error(w, stderr, http.StatusBadRequest)
 
 		return
 	}
 
+	audit(r, "scrub-pause", name, true, "")
 	log.Println(fmt.Sprintf("%s paused scrub for pool %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -193,7 +233,9 @@ func mountHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.Mount(name); err != nil {
+	if stderr, err := zpool.Mount(r.Context(), name); err != nil {
+		audit(r, "mount", name, false, stderr)
+
 		if strings.Index(stderr, "encryption key not loaded") != -1 {
 			http.Error(w, "Encryption key is not loaded", http.StatusBadRequest)
 		} else {
@@ -204,6 +246,7 @@ func mountHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit(r, "mount", name, true, "")
 	log.Println(fmt.Sprintf("%s mounted dataset %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -220,13 +263,16 @@ func unmountHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.Unmount(name); err != nil {
+	if stderr, err := zpool.Unmount(r.Context(), name); err != nil {
+		audit(r, "unmount", name, false, stderr)
+
 		log.Printf("Unable to unmount dataset %s: %s. %s", name, err, stderr)
 		http.Error(w, msgErrorOccurred, http.StatusBadRequest)
 
 		return
 	}
 
+	audit(r, "unmount", name, true, "")
 	log.Println(fmt.Sprintf("%s unmounted dataset %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -243,12 +289,15 @@ func trimHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if stderr, err := zpool.Trim(name); err != nil {
+	if stderr, err := zpool.Trim(r.Context(), name); err != nil {
+		audit(r, "trim", name, false, stderr)
+
 		log.Printf("Unable to trim pool %s: %s. %s", name, err, stderr)
 		http.Error(w, msgErrorOccurred, http.StatusBadRequest)
 		return
 	}
 
+	audit(r, "trim", name, true, "")
 	log.Println(fmt.Sprintf("%s trimmed pool %s", username, name))
 	http.Error(w, "", http.StatusOK)
 }
@@ -264,10 +313,9 @@ func iostatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stdout, err := zpool.Iostat(name)
+	stdout, err := zpool.Iostat(r.Context(), name)
 	if err != nil {
-		log.Printf("Unable to get stats for pool %s: %s", name, err)
-		http.Error(w, msgErrorOccurred, http.StatusBadRequest)
+		ReportCommandError(w, err)
 		return
 	}
 
@@ -275,26 +323,281 @@ func iostatHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func browseFilesHandler(w http.ResponseWriter, r *http.Request) {
-	var files []File
 	username := getUsername(r, w)
 	if username == "" {
-		log.Printf("not authed")
 		return
 	}
 
 	path, ok := GetHMAC(r)
 	if !ok {
-		log.Printf("bad hmac")
+		ReportInvalid(w)
+		return
+	}
+
+	path = resolveBrowsePath(path)
+	log.Printf("%s browsed to %s", username, path)
+
+	started := false
+	err := runBrowser(r.Context(), []string { "-f", path }, func(msg *browser.Message, payload io.Reader) error {
+		if msg.Type == browser.TypeListing {
+			EncodeAndSend(w, NewListing(path, msg.Entries))
+			return nil
+
+		} else if msg.Type != browser.TypeFile {
+			return fmt.Errorf("unexpected message type %s", msg.Type)
+		}
+
+		started = true
+		removeWriteDeadline(w)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", msg.Name))
+
+		_, err := io.Copy(w, payload)
+		return err
+	})
+
+	if err != nil {
+		reportBrowserError(w, err, started)
+	}
+}
+
+func archiveFilesHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	path, ok := GetHMAC(r)
+	if !ok {
+		ReportInvalid(w)
+		return
+	}
+	path = resolveBrowsePath(path)
+
+	format, _ := GetParameter(r, "format")
+	if format == "" {
+		format = "tar.gz"
+	} else if format != "tar.gz" && format != "zip" {
+		http.Error(w, "Unknown archive format", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("%s downloaded %s as %s", username, path, format)
+
+	started := false
+	err := runBrowser(r.Context(), []string { "-f", path, "-a", format }, func(msg *browser.Message, payload io.Reader) error {
+		if msg.Type != browser.TypeArchive {
+			return fmt.Errorf("unexpected message type %s", msg.Type)
+		}
+
+		started = true
+		removeWriteDeadline(w)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", msg.Name, format))
+
+		_, err := io.Copy(w, payload)
+		return err
+	})
+
+	if err != nil {
+		reportBrowserError(w, err, started)
+	}
+}
+
+func searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	path, okPath := GetHMAC(r)
+	pattern, okPattern := GetParameter(r, "q")
+	if !okPath || !okPattern {
+		ReportMissing(w)
+		return
+	}
+	path = resolveBrowsePath(path)
+
+	// Limits are optional and capped by the browser config
+	depth, _ := GetParameter(r, "depth")
+	limit, _ := GetParameter(r, "limit")
+	budget, _ := GetParameter(r, "time")
+
+	args := []string {
+		"-f", path,
+		"-s=" + pattern,
+		"-d=" + strconv.Itoa(atoiDefault(depth)),
+		"-n=" + strconv.Itoa(atoiDefault(limit)),
+		"-t=" + strconv.Itoa(atoiDefault(budget)),
+	}
+
+	log.Printf("%s searched %s for %q", username, path, pattern)
+
+	err := runBrowser(r.Context(), args, func(msg *browser.Message, payload io.Reader) error {
+		if msg.Type != browser.TypeSearch {
+			return fmt.Errorf("unexpected message type %s", msg.Type)
+		}
+
+		results := make([]File, 0, len(msg.Entries))
+		for _, entry := range msg.Entries {
+			results = append(results, newFile(entry, path + "/" + entry.Name))
+		}
+
+		ret := struct {
+			Path      string
+			Truncated bool
+			Results   []File
+		} {
+			path,
+			msg.Truncated,
+			results,
+		}
+
+		EncodeAndSend(w, ret)
+		return nil
+	})
+
+	if err != nil {
+		reportBrowserError(w, err, false)
+	}
+}
+
+// Reports which snapshots of a dataset contain the relative path in the "path" parameter
+func fileHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	dataset, okDataset := GetHMAC(r)
+	rel, okRel := GetParameter(r, "path")
+	if !okDataset || !okRel {
+		ReportMissing(w)
+		return
+	}
+
+	// Snapshots are accepted so the search can be started from any snapshot of the dataset
+	dataset = strings.Split(dataset, "@")[0]
+	root := resolveBrowsePath(dataset)
+
+	log.Printf("%s searched snapshots of %s for %q", username, dataset, rel)
+
+	err := runBrowser(r.Context(), []string { "-f", root, "-r=" + rel }, func(msg *browser.Message, payload io.Reader) error {
+		if msg.Type != browser.TypeHistory {
+			return fmt.Errorf("unexpected message type %s", msg.Type)
+		}
+
+		snapshots := make([]File, 0, len(msg.Entries))
+		for _, entry := range msg.Entries {
+			path := fmt.Sprintf("%s/.zfs/snapshot/%s/%s", root, entry.Name, msg.Name)
+
+			entry.Name = dataset + "@" + entry.Name
+			snapshots = append(snapshots, newFile(entry, path))
+		}
+
+		ret := struct {
+			Dataset   string
+			Path      string
+			Snapshots []File
+		} {
+			dataset,
+			msg.Name,
+			snapshots,
+		}
+
+		EncodeAndSend(w, ret)
+		return nil
+	})
+
+	if err != nil {
+		reportBrowserError(w, err, false)
+	}
+}
+
+func previewFileHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	path, ok := GetHMAC(r)
+	if !ok {
+		ReportInvalid(w)
+		return
+	}
+	path = resolveBrowsePath(path)
+
+	// The preview size is in KiB and is capped by the browser config
+	size := 64
+	if raw, ok := GetParameter(r, "size"); ok {
+		size = atoiDefault(raw)
+	}
+
+	if size <= 0 {
+		http.Error(w, "Invalid preview size", http.StatusBadRequest)
 		return
 	}
 
+	log.Printf("%s previewed %s", username, path)
+
+	args := []string { "-f", path, "-p", strconv.Itoa(size * 1024) }
+	err := runBrowser(r.Context(), args, func(msg *browser.Message, payload io.Reader) error {
+		if msg.Type != browser.TypePreview {
+			return fmt.Errorf("unexpected message type %s", msg.Type)
+		}
+
+		mime, ok := PreviewType(msg.MIME)
+		if !ok {
+			http.Error(w, "Previews are not available for " + msg.MIME, http.StatusUnsupportedMediaType)
+			return nil
+		}
+
+		// Previews are small enough to buffer which allows the error to be reported if the payload is incomplete
+		data, err := ioutil.ReadAll(payload)
+		if err != nil {
+			return err
+		}
+
+		// Previews are rendered directly by the browser so they are locked down even further than the rest of the UI
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; sandbox;")
+		w.Header().Set("Content-Type", mime)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", msg.Name))
+		w.Header().Set("X-Preview-Truncated", strconv.FormatBool(msg.Truncated))
+
+		w.Write(data)
+		return nil
+	})
+
+	if err != nil {
+		reportBrowserError(w, err, false)
+	}
+}
+
+// Returns the Content-Type to serve a preview with and false if the detected type should not be displayed inline.
+// All text is served as plain text so that HTML, SVG and similar files can never execute scripts.
+func PreviewType(detected string) (string, bool) {
+	images := []string { "image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp" }
+	for _, image := range images {
+		if detected == image {
+			return image, true
+		}
+	}
+
+	if detected == "application/json" {
+		return detected, true
+	} else if strings.HasPrefix(detected, "text/") {
+		return "text/plain; charset=utf-8", true
+	}
+
+	return "", false
+}
+
+// Converts a dataset, snapshot or path inside of either into an absolute path on disk
+func resolveBrowsePath(path string) string {
 	// Dataset names aren't prefixed with a slash
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
 
-	log.Printf("%s browsed to %s", username, path)
-
 	// Check if this is a snapshot
 	if strings.Contains(path, "@") {
 		// given "test/test@SNAP", we need to browse to "/test/test/.zfs/snapshot/SNAP"
@@ -303,55 +606,96 @@ func browseFilesHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Browsed to snapshot '%s' at path '%s'", parts[0], path)
 	}
 
-	// TODO: Lifeguard could verify that the browser binary has a signature on it
-	// The signature can be from any key but the public key must be printed at startup
-	//    and must be the same between all binaries
-	contents, stderr, err := zpool.Exec([]string { "./browser", "-f", path })
+	return path
+}
+
+// Converts a listing type and octal mode (such as "d" and "0755") into the format used by ls (such as "drwxr-xr-x")
+func FormatPermissions(typeChar string, mode string) string {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return ""
+	}
+
+	perms := []byte("-rwxrwxrwx")
+	if typeChar != "f" && typeChar != "@" {
+		perms[0] = typeChar[0]
+	}
 
-	if len(contents) <= 3 || err != nil {
-		http.Error(w, "Unable to list contents", http.StatusInternalServerError)
-		log.Printf("Unable to list contents of %s: %s. Error: %s", path, err, stderr)
-		return
+	for i := 0; i < 9; i++ {
+		if bits & (1 << uint(8 - i)) == 0 {
+			perms[i + 1] = '-'
+		}
 	}
 
-	// test if this is a folder or file
-	if contents[:4] == "fold" {
-		contents = contents[4:]
+	// Setuid, setgid and sticky replace the execute bit of the owner, group and other triplets respectively
+	special := []struct {
+		bit   uint64
+		index int
+		char  byte
+	} {
+		{ 04000, 3, 's' },
+		{ 02000, 6, 's' },
+		{ 01000, 9, 't' },
+	}
 
-		// The first item with type "@" is the current path that we are at
-	files = append(files, File {
-		Type: "@",
-		Name: path,
-		HMAC: "",
-		Size: "0",
-	})
+	for _, s := range special {
+		if bits & s.bit == 0 {
+			continue
+		}
 
-	for _, raw := range strings.Split(contents, "\n") {
-		parts := strings.Split(raw, " ")
-		if len(parts) != 3 {
-			break
+		if perms[s.index] == '-' {
+			perms[s.index] = s.char - ('a' - 'A')
+		} else {
+			perms[s.index] = s.char
 		}
+	}
 
-		decoded, _ := base64.StdEncoding.DecodeString(parts[1])
-		
-		current := path + "/" + string(decoded)
-		hmac := crypto.GenerateHMAC(current)
+	return string(perms)
+}
+
+// Converts the entries in a listing from the browser into the format sent to the web UI
+func NewListing(path string, entries []browser.Entry) []File {
+	// The first item with type "@" is the current path that we are at
+	files := []File {
+		{
+			Type: "@",
+			Name: path,
+			HMAC: crypto.GenerateHMAC(path),
+			Size: "0",
+		},
+	}
 
-		files = append(files, File {
-			Type: parts[0],
-			Name: string(decoded),
-			HMAC: hmac,
-			Size: parts[2],
-		})
+	for _, entry := range entries {
+		files = append(files, newFile(entry, path + "/" + entry.Name))
 	}
 
-	EncodeAndSend(w, files)
+	return files
+}
 
-	} else if contents[:4] == "file" {
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(path)))
-		w.Write([]byte(contents[4:]))
+// Converts a single entry from the browser into a file. The HMAC is calculated over path.
+func newFile(entry browser.Entry, path string) File {
+	mode := fmt.Sprintf("%04o", entry.Mode)
+
+	return File {
+		Type:        entry.Type,
+		Name:        entry.Name,
+		HMAC:        crypto.GenerateHMAC(path),
+		Size:        strconv.FormatInt(entry.Size, 10),
+		Modified:    entry.Modified,
+		Mode:        mode,
+		Permissions: FormatPermissions(entry.Type, mode),
+		Owner:       entry.Owner,
+		Group:       entry.Group,
+		Target:      entry.Target,
+	}
+}
 
-	} else {
-		http.Error(w, "Unknown type", http.StatusInternalServerError)
+// Parses raw as an integer, returning zero if it is empty or invalid
+func atoiDefault(raw string) int {
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0
 	}
+
+	return value
 }
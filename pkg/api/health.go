@@ -0,0 +1,103 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+)
+
+// Result of a single readiness check. Latency is in milliseconds. Errors are only logged since they can contain paths
+// and other details that unauthenticated callers shouldn't see.
+type HealthCheck struct {
+	Status  string
+	Latency float64
+}
+
+type HealthReport struct {
+	Status string
+	Checks map[string]HealthCheck `json:",omitempty"`
+}
+
+// Checks run by the readiness endpoint and the systemd watchdog. Tests replace them to simulate failures.
+var ReadinessChecks = map[string]func(ctx context.Context) error {
+	"database": func(ctx context.Context) error {
+		return config.Ping()
+	},
+	"zfs": func(ctx context.Context) error {
+		_, err := zpool.GetVersion(ctx)
+		return err
+	},
+}
+
+// These endpoints don't require authentication so that load balancers and monitoring can use them. They only report
+// the outcome of each check.
+func SetupHealth(r *mux.Router) {
+	r.HandleFunc("/healthz", livenessHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", readinessHandler).Methods("GET", "HEAD")
+}
+
+func sendHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if report.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(report)
+}
+
+// Only confirms that requests are being handled
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	sendHealth(w, HealthReport { Status: healthOK })
+}
+
+// Runs every readiness check and returns the result and latency of each
+func runReadinessChecks(ctx context.Context) HealthReport {
+	report := HealthReport {
+		Status: healthOK,
+		Checks: make(map[string]HealthCheck),
+	}
+
+	for name, check := range ReadinessChecks {
+		start := time.Now()
+		err := check(ctx)
+
+		result := HealthCheck {
+			Status:  healthOK,
+			Latency: float64(time.Since(start).Microseconds()) / 1000,
+		}
+
+		if err != nil {
+			log.Printf("Readiness check %s failed: %s", name, err)
+
+			result.Status = healthFail
+			report.Status = healthFail
+		}
+
+		report.Checks[name] = result
+	}
+
+	return report
+}
+
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	sendHealth(w, runReadinessChecks(r.Context()))
+}
@@ -8,15 +8,16 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/zpool"
 
 	"github.com/gorilla/mux"
 )
 
 func SetupInfo(r *mux.Router) {
 	r.HandleFunc("/api/v0/info", infoHandler).Methods("GET")
-	r.HandleFunc("/api/v0/support", supportHandler).Methods("GET")
+	r.HandleFunc("/api/v0/support", requirePermission(structs.PermView, supportHandler)).Methods("GET")
 }
 
 func infoHandler(w http.ResponseWriter, r *http.Request) {
@@ -26,9 +27,22 @@ func infoHandler(w http.ResponseWriter, r *http.Request) {
 	info["Product"] = "Lifeguard"
 	info["Authenticated"] = auth
 	info["Debug"] = config.DevMode
+	info["CSRFToken"] = getCSRFToken(w, r)
 
 	if auth {
-		info["ZFSVersion"] = zpool.GetVersion()
+		username := getUsernameQuiet(r)
+		role := config.GetRole(username)
+
+		scopes, err := config.GetScopes(username)
+		if err != nil {
+			ReportDatabaseError(w, err)
+			return
+		}
+
+		info["Role"] = role
+		info["Permissions"] = structs.RolePermissions[role]
+		info["Scopes"] = scopes
+		info["ZFSVersion"], _ = zpool.GetVersion(r.Context())
 
 		info["Commit"] = config.Commit + config.Modified
 		info["BuildTime"] = config.BuildTime
@@ -45,10 +59,22 @@ func supportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	userAgent := r.UserAgent()
-	zfsVersion := zpool.GetVersion()
+	zfsVersion, err := zpool.GetVersion(r.Context())
+	if err != nil {
+		zfsVersion = "unknown (" + err.Error() + ")"
+	}
+
 	buildInfo := fmt.Sprintf("commit %s built at %s with %s", config.Commit + config.Modified, config.BuildTime, config.GoVersion)
-	lsb := zpool.MustExec([]string { "/usr/bin/lsb_release", "-d"})
-	kernel := zpool.MustExec([]string { "/bin/uname", "-r"})
+	// These are only informational so failures are included in the report instead of failing the request
+	lsb, err := zpool.ExecOutput(r.Context(), []string { "/usr/bin/lsb_release", "-d"})
+	if err != nil {
+		lsb = "Description: unknown (" + err.Error() + ")"
+	}
+
+	kernel, err := zpool.ExecOutput(r.Context(), []string { "/bin/uname", "-r"})
+	if err != nil {
+		kernel = "unknown (" + err.Error() + ")"
+	}
 
 	lsb = strings.ReplaceAll(lsb, "\n", "")
 	lsb = strings.ReplaceAll(lsb, "\t", "")
@@ -0,0 +1,242 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/notifications"
+
+	"github.com/gorilla/mux"
+)
+
+// Failed login and 2FA attempts are limited per username and per source IP. After a few failures, each attempt must
+// wait twice as long as the previous one and once too many attempts have failed, the username or IP is locked out.
+const (
+	backoffAfter    = 3
+	maxBackoff      = time.Minute
+	userLockout     = 10
+	ipLockout       = 25
+	lockoutDuration = 15 * time.Minute
+
+	// Failures older than this are forgotten
+	failureWindow = time.Hour
+)
+
+const (
+	lockoutUser = "user"
+	lockoutIP   = "ip"
+)
+
+type attempts struct {
+	Failures    int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+// Returned to administrators when listing lockouts
+type Lockout struct {
+	Kind        string
+	Key         string
+	Failures    int
+	LockedUntil int64
+}
+
+var (
+	attemptsLock sync.Mutex
+	userAttempts = make(map[string]*attempts)
+	ipAttempts   = make(map[string]*attempts)
+)
+
+func SetupLockout(r *mux.Router) {
+	r.HandleFunc("/api/v0/lockouts", requireAdmin(listLockoutsHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/lockouts/unlock", requireAdmin(unlockHandler)).Methods("POST")
+}
+
+// Returns how long the caller must wait before another attempt is allowed, or zero if it can be made now
+func (a *attempts) wait(now time.Time) time.Duration {
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now)
+	}
+
+	if a.Failures < backoffAfter {
+		return 0
+	}
+
+	delay := time.Second << uint(a.Failures - backoffAfter)
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	if next := a.Last.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+
+	return 0
+}
+
+// Records a failure and returns true if it caused a lockout
+func (a *attempts) fail(now time.Time, lockoutAt int) bool {
+	a.Failures++
+	a.Last = now
+
+	if a.Failures >= lockoutAt {
+		a.Failures = 0
+		a.LockedUntil = now.Add(lockoutDuration)
+		return true
+	}
+
+	return false
+}
+
+// Removes entries that no longer affect anything so failures for random usernames don't accumulate forever
+func pruneAttempts(table map[string]*attempts, now time.Time) {
+	for key, a := range table {
+		if now.Sub(a.Last) > failureWindow && now.After(a.LockedUntil) {
+			delete(table, key)
+		}
+	}
+}
+
+// Checks if an authentication attempt for username from the request's source IP is allowed. If it isn't, an error
+// with a Retry-After header is sent and false is returned.
+func allowAttempt(w http.ResponseWriter, r *http.Request, username string) bool {
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+
+	now := time.Now()
+	pruneAttempts(userAttempts, now)
+	pruneAttempts(ipAttempts, now)
+
+	var wait time.Duration
+	if a, ok := userAttempts[username]; ok {
+		wait = a.wait(now)
+	}
+
+	if a, ok := ipAttempts[clientIP(r)]; ok {
+		if ipWait := a.wait(now); ipWait > wait {
+			wait = ipWait
+		}
+	}
+
+	if wait == 0 {
+		return true
+	}
+
+	log.Printf("WARNING %s cannot authenticate as %s for another %s", clientIP(r), username, wait.Round(time.Second))
+
+	seconds := int(wait.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds), http.StatusTooManyRequests)
+
+	return false
+}
+
+func recordFailure(r *http.Request, username string) {
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+
+	now := time.Now()
+	ip := clientIP(r)
+
+	if _, ok := userAttempts[username]; !ok {
+		userAttempts[username] = &attempts{}
+	}
+
+	if _, ok := ipAttempts[ip]; !ok {
+		ipAttempts[ip] = &attempts{}
+	}
+
+	if userAttempts[username].fail(now, userLockout) {
+		notifications.SendNotification(6, "warning", fmt.Sprintf("Account \"%s\" locked for %s after %d failed login attempts (last from %s)",
+			username, lockoutDuration, userLockout, ip))
+	}
+
+	if ipAttempts[ip].fail(now, ipLockout) {
+		notifications.SendNotification(6, "warning", fmt.Sprintf("Address %s locked out for %s after %d failed login attempts",
+			ip, lockoutDuration, ipLockout))
+	}
+}
+
+// Clears the failures for username after a successful login. Failures from the source IP are kept since an attacker
+// could otherwise reset the IP limit by periodically logging in to an account they control.
+func recordSuccess(r *http.Request, username string) {
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+
+	delete(userAttempts, username)
+}
+
+func listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+
+	now := time.Now()
+	lockouts := make([]Lockout, 0)
+
+	add := func(kind string, table map[string]*attempts) {
+		for key, a := range table {
+			if now.After(a.LockedUntil) && a.Failures == 0 {
+				continue
+			}
+
+			locked := int64(0)
+			if now.Before(a.LockedUntil) {
+				locked = a.LockedUntil.Unix()
+			}
+
+			lockouts = append(lockouts, Lockout {
+				Kind:        kind,
+				Key:         key,
+				Failures:    a.Failures,
+				LockedUntil: locked,
+			})
+		}
+	}
+
+	add(lockoutUser, userAttempts)
+	add(lockoutIP, ipAttempts)
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Kind != lockouts[j].Kind {
+			return lockouts[i].Kind > lockouts[j].Kind
+		}
+
+		return lockouts[i].Key < lockouts[j].Key
+	})
+
+	EncodeAndSend(w, lockouts)
+}
+
+func unlockHandler(w http.ResponseWriter, r *http.Request) {
+	kind, okKind := GetParameter(r, "Kind")
+	key, okKey := GetParameter(r, "Key")
+	if !okKind || !okKey {
+		ReportMissing(w)
+		return
+	}
+
+	attemptsLock.Lock()
+	defer attemptsLock.Unlock()
+
+	switch kind {
+	case lockoutUser:
+		delete(userAttempts, key)
+	case lockoutIP:
+		delete(ipAttempts, key)
+	default:
+		ReportInvalid(w)
+		return
+	}
+
+	audit(r, "unlock", key, true, "")
+	log.Printf("%s unlocked %s %s", getUsernameQuiet(r), kind, key)
+	http.Error(w, "OK", http.StatusOK)
+}
@@ -6,7 +6,9 @@ package api
 import (
 	"net/http"
 
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 	"github.com/ConfusedPolarBear/lifeguard/pkg/notifications"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
 
 	"github.com/gorilla/mux"
 )
@@ -15,13 +17,20 @@ func SetupNotifications(r *mux.Router) {
 	notifications.Initialize()
 
 	// List all notifications
-	r.HandleFunc("/api/v0/notifications/list", getNotifications).Methods("GET")
+	r.HandleFunc("/api/v0/notifications/list", requirePermission(structs.PermView, getNotifications)).Methods("GET")
 }
 
 func getNotifications(w http.ResponseWriter, r *http.Request) {
-	if !checkSessionAuth(r, w) {
+	username := getUsername(r, w)
+	if username == "" {
 		return
 	}
 
-	EncodeAndSend(w, notifications.Notifications)
+	scopes, err := config.GetScopes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, filterNotifications(scopes, notifications.List()))
 }
\ No newline at end of file
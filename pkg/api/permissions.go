@@ -0,0 +1,65 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/gorilla/mux"
+)
+
+// Wraps handler so that it only runs if the user is authenticated, their role grants perm and the object identified by
+// the "id" HMAC (if any) is within their scopes. Since HMACs aren't secret, possessing one doesn't grant any access.
+func requirePermission(perm string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := getUsername(r, w)
+		if username == "" {
+			return
+		}
+
+		if !hasPermission(r, username, perm) {
+			log.Printf("%s cannot access %s: missing permission %s", username, r.URL, perm)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if id, ok := mux.Vars(r)["id"]; ok {
+			object := crypto.LookupHMAC(id)
+
+			scopes, err := config.GetScopes(username)
+			if err != nil {
+				ReportDatabaseError(w, err)
+				return
+			}
+
+			if object != "" && !InScope(scopes, object) {
+				log.Printf("%s cannot access %s: %s is out of scope", username, r.URL, object)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+// Wraps handler so that it can only be used by administrators who are logged in. Administrative actions can change
+// accounts and sign-in settings, so API tokens can't use them even with the admin scope.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return requireSession(requirePermission(structs.PermAdmin, handler))
+}
+
+// Requests authenticated with an API token are limited to the permissions that are granted to both the token and the role
+func hasPermission(r *http.Request, username string, perm string) bool {
+	if token, ok := getRequestToken(r); ok && !token.HasScope(perm) {
+		return false
+	}
+
+	return structs.RoleHasPermission(config.GetRole(username), perm)
+}
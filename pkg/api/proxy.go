@@ -0,0 +1,152 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+)
+
+// Reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are believed. Replaced when the
+// configuration is reloaded.
+var trustedProxies []*net.IPNet
+var proxyLock sync.RWMutex
+
+// Loads the comma separated list of addresses and CIDRs in proxy.trusted
+func setupProxies() error {
+	var proxies []*net.IPNet
+
+	for _, raw := range strings.Split(config.GetString("proxy.trusted", ""), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+
+		// Plain addresses are treated as a network containing only that address
+		if !strings.Contains(raw, "/") {
+			if ip := net.ParseIP(raw); ip != nil && ip.To4() != nil {
+				raw += "/32"
+			} else {
+				raw += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %s: %s", raw, err)
+		}
+
+		proxies = append(proxies, network)
+	}
+
+	proxyLock.Lock()
+	trustedProxies = proxies
+	proxyLock.Unlock()
+
+	if len(proxies) != 0 {
+		log.Printf("Trusting forwarded headers from %d proxies", len(proxies))
+	}
+
+	return nil
+}
+
+func isTrustedProxy(raw string) bool {
+	ip := net.ParseIP(raw)
+	if ip == nil {
+		return false
+	}
+
+	proxyLock.RLock()
+	defer proxyLock.RUnlock()
+
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address that the connection was made from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// Returns the address of the client that sent the request. If the request came through trusted proxies, this is the
+// last address in X-Forwarded-For that wasn't added by one of them.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Returns "https" if the client connected over TLS, either directly or to a trusted proxy
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if isTrustedProxy(remoteIP(r)) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+
+	return "http"
+}
+
+// Returns the path that the API and web UI are served under (such as "/lifeguard") or an empty string if they are
+// served at the root
+func getPathPrefix() string {
+	prefix := strings.Trim(config.GetString("server.prefix", ""), "/")
+	if prefix == "" {
+		return ""
+	}
+
+	return "/" + prefix
+}
+
+// Serves handler under prefix. Requesting the prefix itself redirects to the web UI so that its relative URLs work.
+func withPathPrefix(prefix string, handler http.Handler) http.Handler {
+	stripped := http.StripPrefix(prefix, handler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == prefix {
+			http.Redirect(w, r, prefix + "/", http.StatusMovedPermanently)
+			return
+		}
+
+		stripped.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+
+	"github.com/gorilla/mux"
+)
+
+// Number of recovery codes generated at once
+const recoveryCodeCount = 10
+
+func SetupRecovery(r *mux.Router) {
+	r.HandleFunc("/api/v0/tfa/recovery", requireSession(recoveryStatusHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/tfa/recovery/regenerate", requireSession(regenerateRecoveryHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/tfa/recovery/authenticate", recoveryChallengeHandler).Methods("POST")
+}
+
+// Codes are compared without dashes, spaces or case so they can be typed however they were written down
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Replaces the user's recovery codes with new ones and returns them. This is the only time the plaintext codes exist.
+func generateRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := crypto.GetRandom(5)
+
+		codes = append(codes, raw[:5] + "-" + raw[5:])
+		hashes = append(hashes, crypto.HashToken(raw))
+	}
+
+	if err := config.SetRecoveryCodes(username, hashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Returns true if code is one of the user's unused recovery codes. The code is consumed if it was valid.
+func useRecoveryCode(username string, code string) (bool, error) {
+	code = normalizeRecoveryCode(code)
+	if code == "" {
+		return false, nil
+	}
+
+	if ok, err := config.UseRecoveryCode(username, crypto.HashToken(code)); !ok || err != nil {
+		return false, err
+	}
+
+	remaining, _ := config.CountRecoveryCodes(username)
+	log.Printf("%s used a recovery code, %d remaining", username, remaining)
+	return true, nil
+}
+
+func recoveryStatusHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+
+	remaining, err := config.CountRecoveryCodes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	ret := struct {
+		Remaining int
+	} {
+		remaining,
+	}
+
+	EncodeAndSend(w, ret)
+}
+
+func regenerateRecoveryHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+
+	if enabled, err := config.IsTwoFactorEnabled(username); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !enabled {
+		http.Error(w, "Two factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "regenerate-recovery-codes", username, true, "")
+	log.Printf("%s regenerated their recovery codes", username)
+
+	ret := struct {
+		Codes []string
+	} {
+		codes,
+	}
+
+	EncodeAndSend(w, ret)
+}
+
+func recoveryChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+
+	username := getPartialAuth(r)
+	if username == "" {
+		http.Error(w, "Invalid state", http.StatusForbidden)
+		return
+	}
+
+	if !allowAttempt(w, r, username) {
+		return
+	}
+
+	code, codeOk := GetParameter(r, "code")
+	if !codeOk {
+		ReportMissing(w)
+		return
+	}
+
+	ok, err := useRecoveryCode(username, code)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		log.Printf("%s failed 2FA challenge: Invalid recovery code", username)
+		recordFailure(r, username)
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+
+	recordSuccess(r, username)
+
+	if !finishTwoFactor(w, r, session) {
+		return
+	}
+
+	http.Error(w, "OK", http.StatusOK)
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"path"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+// Returns true if object (a pool, dataset, snapshot or path inside of one) is inside one of the scopes. A scope grants
+// access to a pool or dataset along with all of its children and snapshots. An empty list of scopes is unrestricted.
+func InScope(scopes []string, object string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+
+	// Paths inside a dataset are checked against the dataset ("/tank/data/file" -> "tank/data/file") and snapshots
+	// are checked against the dataset they belong to ("tank/data@snap" -> "tank/data")
+	object = path.Clean("/" + object)[1:]
+	object = strings.SplitN(object, "@", 2)[0]
+
+	for _, scope := range scopes {
+		if object == scope || strings.HasPrefix(object, scope + "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the pool should be listed, which is the case if the user can access any part of it
+func PoolVisible(scopes []string, pool string) bool {
+	if InScope(scopes, pool) {
+		return true
+	}
+
+	for _, scope := range scopes {
+		if strings.HasPrefix(scope, pool + "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Removes datasets or snapshots which are outside of the scopes from the output of zpool.GetProperties
+func filterProperties(scopes []string, all []map[string]*structs.Property) []map[string]*structs.Property {
+	if len(scopes) == 0 {
+		return all
+	}
+
+	var filtered []map[string]*structs.Property
+	for _, props := range all {
+		if name, ok := props["name"]; ok && InScope(scopes, name.Value) {
+			filtered = append(filtered, props)
+		}
+	}
+
+	return filtered
+}
+
+// Removes notifications about pools that are not visible. Notifications that aren't about a pool (such as account
+// lockouts) are only kept for unrestricted users.
+func filterNotifications(scopes []string, all []structs.Notification) []structs.Notification {
+	if len(scopes) == 0 {
+		return all
+	}
+
+	filtered := make([]structs.Notification, 0)
+	for _, n := range all {
+		if n.Pool != "" && PoolVisible(scopes, n.Pool) {
+			filtered = append(filtered, n)
+		}
+	}
+
+	return filtered
+}
+
+// Removes pools that are not visible and any datasets and snapshots that are outside of the scopes
+func filterPools(scopes []string, pools []*structs.Pool) []*structs.Pool {
+	if len(scopes) == 0 {
+		return pools
+	}
+
+	filtered := make([]*structs.Pool, 0)
+	for _, pool := range pools {
+		if !PoolVisible(scopes, pool.Name) {
+			continue
+		}
+
+		// Copy the pool since the original is also saved for sending notifications
+		copied := *pool
+		copied.Datasets = filterProperties(scopes, pool.Datasets)
+		copied.Snapshots = filterProperties(scopes, pool.Snapshots)
+		filtered = append(filtered, &copied)
+	}
+
+	return filtered
+}
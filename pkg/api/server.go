@@ -4,8 +4,11 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -25,7 +28,7 @@ import (
 
 var (
 	key = []byte("")			// use a temporary key so key and store are accessible throughout the api package
-	store = sessions.NewCookieStore(key)
+	store = NewSessionStore(key, time.Hour, time.Hour)
 )
 
 // This is used by getPropertiesHandler to construct the fields object. The custom JSON fields are needed because go won't export struct members with a lowercase name.
@@ -42,19 +45,6 @@ func Setup() {
 		port = ":5120"
 	}
 
-	key = []byte(config.GetString("keys.session", ""))
-
-	// Validate session options
-	if len(key) != 32 {
-		log.Println("Regenerating session key")
-
-		temp := strings.ToUpper(crypto.GetRandom(16))
-		key = []byte(temp)
-		config.Set("keys.session", temp)
-	}
-
-	store = sessions.NewCookieStore(key)
-
 	if !config.IsUser("admin") {
 		fmt.Print("Enter new password for user admin: ")
 
@@ -63,19 +53,102 @@ func Setup() {
 			log.Fatalf("Unable to get password: %s", err)
 		}
 
-		config.CreateUser("admin", crypto.HashPassword(string(bytePassword)), nil)
+		if err := config.CreateUser("admin", crypto.HashPassword(string(bytePassword)), structs.RoleAdmin, nil); err != nil {
+			log.Fatalf("Unable to create admin user: %s", err)
+		}
 
 		fmt.Println()
 		log.Printf("Password successfully hashed and saved")
 	}
 
+	tlsConfig := setupTLS()
+	if err := setupProxies(); err != nil {
+		log.Fatalf("Unable to load proxy configuration: %s", err)
+	}
+
+	if err := setupSSO(); err != nil {
+		log.Fatalf("Unable to load single sign on configuration: %s", err)
+	}
+
+	if err := LoadSessionStore(tlsConfig != nil); err != nil {
+		log.Fatalf("Unable to load session configuration: %s", err)
+	}
+
+	srv := &http.Server{
+		Handler:      NewRouter(),
+		Addr:         port,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		TLSConfig:    tlsConfig,
+		ConnContext:  PeerContext,
+	}
+
+	servers := []*http.Server { srv }
+	errs := make(chan error, 8)
+
+	// Listeners passed by systemd socket activation replace the configured bind address and Unix socket
+	inherited := SystemdListeners()
+	for _, listener := range inherited {
+		listener := listener
+		log.Printf("Listening on %s (inherited from systemd)", listener.Addr())
+
+		if _, isUnix := listener.(*net.UnixListener); isUnix || tlsConfig == nil {
+			serveBackground(errs, func() error { return srv.Serve(listener) })
+		} else {
+			serveBackground(errs, func() error { return srv.ServeTLS(listener, "", "") })
+		}
+	}
+
+	if len(inherited) == 0 {
+		servers = listen(srv, port, errs)
+	}
+
+	SystemdNotify("READY=1")
+	go watchdog()
+
+	waitForShutdown(errs, servers)
+}
+
+// Loads the session key and timeouts and replaces the session store. Secure sets whether session cookies are only
+// sent over HTTPS. A new session key is generated if there isn't a valid one.
+func LoadSessionStore(secure bool) error {
+	key = []byte(config.GetString("keys.session", ""))
+
+	if len(key) != 32 {
+		log.Println("Regenerating session key")
+
+		temp := strings.ToUpper(crypto.GetRandom(16))
+		key = []byte(temp)
+		if err := config.Set("keys.session", temp); err != nil {
+			return fmt.Errorf("unable to save session key: %w", err)
+		}
+	}
+
+	idle, errIdle := time.ParseDuration(config.GetString("sessions.idle_timeout", "12h"))
+	lifetime, errLifetime := time.ParseDuration(config.GetString("sessions.lifetime", "720h"))
+	if errIdle != nil || errLifetime != nil {
+		return fmt.Errorf("invalid session timeout: %v %v", errIdle, errLifetime)
+	}
+
+	// Cookies are scoped to the path prefix so that other applications behind the same proxy never receive them
+	cookiePath := getPathPrefix()
+	if cookiePath == "" {
+		cookiePath = "/"
+	}
+
+	store = NewSessionStore(key, idle, lifetime)
 	store.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   30 * 86400,   // 30 days
+		Path:     cookiePath,
 		SameSite: http.SameSiteStrictMode,
 		HttpOnly: true,
+		Secure:   secure,
 	}
 
+	return nil
+}
+
+// Returns the handler for every API endpoint and the web UI, including middleware and the configured path prefix
+func NewRouter() http.Handler {
 	r := mux.NewRouter()
 
 	// Security
@@ -85,30 +158,74 @@ func Setup() {
 	r.HandleFunc("/api/v0/tfa/challenge", tfaChallengeHandler).Methods("GET")
 
 	// Pool
-	r.HandleFunc("/api/v0/pool/{pool}", getPoolHandler).Methods("GET")
-	r.HandleFunc("/api/v0/pools", getAllPoolsHandler).Methods("GET")
-	r.HandleFunc("/api/v0/properties/{type}", getPropertyListHandler).Methods("GET")
+	r.HandleFunc("/api/v0/pool/{pool}", requirePermission(structs.PermView, getPoolHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/pools", requirePermission(structs.PermView, getAllPoolsHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/properties/{type}", requirePermission(structs.PermView, getPropertyListHandler)).Methods("GET")
 
 	SetupInfo(r)
+	SetupHealth(r)
 	SetupDataset(r)
 	SetupNotifications(r)
 	SetupTOTP(r)
+	SetupWebAuthn(r)
+	SetupRecovery(r)
+	SetupLockout(r)
+	SetupSessions(r)
+	SetupAudit(r)
+	SetupUsers(r)
+	SetupTokens(r)
+	SetupClientCertificates(r)
+	SetupSocketUsers(r)
 
 	// Static web UI
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./web/dist"))).Methods("GET")
 
 	// Middleware
 	r.Use(securityHeadersMw)
+	r.Use(tokenAuthMw)
+	r.Use(csrfMw)
 
-	srv := &http.Server{
-		Handler:      r,
-		Addr:         port,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+	if prefix := getPathPrefix(); prefix != "" {
+		log.Printf("Serving under %s", prefix)
+		return withPathPrefix(prefix, r)
+	}
+
+	return r
+}
+
+// Starts serving on the configured Unix socket and bind address and returns every server that was started
+func listen(srv *http.Server, port string, errs chan<- error) []*http.Server {
+	servers := []*http.Server { srv }
+
+	socket := listenSocket()
+	if socket != nil {
+		log.Printf("Listening on %s", socket.Addr())
+		serveBackground(errs, func() error { return srv.Serve(socket) })
+	}
+
+	if config.GetBool("socket.only", false) {
+		if socket == nil {
+			log.Fatalf("socket.only is enabled but socket.path is empty")
+		}
+
+	} else if srv.TLSConfig == nil {
+		log.Printf("Listening on %s", port)
+		serveBackground(errs, srv.ListenAndServe)
+
+	} else {
+		if bind := config.GetString("tls.redirect_bind", ""); bind != "" {
+			redirect := newRedirectServer(bind, port)
+			servers = append(servers, redirect)
+
+			log.Printf("Redirecting HTTP requests on %s to HTTPS", bind)
+			serveBackground(errs, redirect.ListenAndServe)
+		}
+
+		log.Printf("Listening on %s (HTTPS)", port)
+		serveBackground(errs, func() error { return srv.ListenAndServeTLS("", "") })
 	}
 
-	log.Printf("Listening on %s", port)
-	log.Fatal(srv.ListenAndServe())
+	return servers
 }
 
 func securityHeadersMw(next http.Handler) http.Handler {
@@ -135,6 +252,11 @@ func securityHeadersMw(next http.Handler) http.Handler {
 		w.Header().Set("X-Frame-Options", "deny")				// forbid framing
 		w.Header().Set("X-Content-Type-Options", "nosniff")		// forbid content type sniffing
 
+		// Only sent over HTTPS as browsers ignore it otherwise
+		if requestScheme(r) == "https" {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -163,6 +285,31 @@ func ReportInvalid(w http.ResponseWriter) {
 	http.Error(w, msg, http.StatusBadRequest)
 }
 
+// Sends the response for a database query that failed. The error itself is only logged.
+func ReportDatabaseError(w http.ResponseWriter, err error) {
+	log.Printf("Database error: %s", err)
+	http.Error(w, "Unable to access the database", http.StatusInternalServerError)
+}
+
+// Sends the response for a zfs command that failed. Missing pools or datasets are reported as 404 and commands that
+// took too long as 504.
+func ReportCommandError(w http.ResponseWriter, err error) {
+	// The client disconnected so nobody is waiting for a response
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	log.Printf("Command failed: %s", err)
+
+	if errors.Is(err, zpool.ErrNotFound) {
+		http.Error(w, "Not found", http.StatusNotFound)
+	} else if errors.Is(err, zpool.ErrTimeout) {
+		http.Error(w, "Timed out waiting for ZFS", http.StatusGatewayTimeout)
+	} else {
+		http.Error(w, "Unable to run ZFS command", http.StatusInternalServerError)
+	}
+}
+
 func GetHMAC(r *http.Request) (string, bool) {
 	data := ""
 	hmac, ok := GetParameter(r, "id")
@@ -183,16 +330,29 @@ func EncodeAndSend(w http.ResponseWriter, raw interface{}) {
 }
 
 func getAllPoolsHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkSessionAuth(r, w) {
+	username := getUsername(r, w)
+	if username == "" {
 		return
 	}
 
-	pools := zpool.ParseAllPools()
-	EncodeAndSend(w, pools)
+	pools, err := zpool.ParseAllPools(r.Context())
+	if err != nil {
+		ReportCommandError(w, err)
+		return
+	}
+
+	scopes, err := config.GetScopes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, filterPools(scopes, pools))
 }
 
 func getPoolHandler(w http.ResponseWriter, r *http.Request) {
-	if !checkSessionAuth(r, w) {
+	username := getUsername(r, w)
+	if username == "" {
 		return
 	}
 
@@ -202,8 +362,24 @@ func getPoolHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	parsed := zpool.ParsePool(pool, true)
-	EncodeAndSend(w, parsed)
+	scopes, err := config.GetScopes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	if !PoolVisible(scopes, pool) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	parsed, err := zpool.ParsePool(r.Context(), pool, true)
+	if err != nil {
+		ReportCommandError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, filterPools(scopes, []*structs.Pool { parsed })[0])
 }
 
 // This handler returns the properties the user has specified in the config.ini file to sort the displayed columns correctly
@@ -245,13 +421,38 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	session := getSession(r)
 
 	sentUsername, password := getAuth(r)
+
+	// A verified client certificate is a complete login on its own unless a different user was asked for
+	if certUser, ok := getClientCertificateUser(r); ok && (sentUsername == "" || sentUsername == certUser) {
+		certificateLogin(w, r, certUser)
+		return
+	}
+
+	if !allowAttempt(w, r, sentUsername) {
+		return
+	}
+
 	auth, username := checkAuth(sentUsername, password)
 	partialAuth := "full"
 
+	twoFactor := false
+	if auth {
+		var err error
+		if twoFactor, err = config.IsTwoFactorEnabled(username); err != nil {
+			ReportDatabaseError(w, err)
+			return
+		}
+	}
+
+	// Logging in always starts a new session so that an identifier planted before login can't be used afterwards
+	if auth {
+		renewSession(session)
+	}
+
 	session.Values["authenticated"] = auth
 	session.Values["username"] = username
 
-	if auth && config.IsTwoFactorEnabled(username) {
+	if auth && twoFactor {
 		partialAuth = "partial"
 		session.Values["partialAuth"] = username
 		session.Values["authenticated"] = false
@@ -263,19 +464,48 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Failures aren't cleared until the second factor is also verified, otherwise logging in again would reset the
+	// limit on guessing the second factor
+	auditAs(r, sentUsername, "login", sentUsername, auth, "")
+
+	if !auth {
+		recordFailure(r, sentUsername)
+	} else if partialAuth == "full" {
+		recordSuccess(r, username)
+	}
+
 	if auth {
-		log.Printf("%s authenticated (%s) from %s", username, partialAuth, r.RemoteAddr)
+		log.Printf("%s authenticated (%s) from %s", username, partialAuth, clientIP(r))
 		http.Error(w, partialAuth, http.StatusOK)
 
 	} else {
-		log.Printf("WARNING %s failed to authenticate as %s", r.RemoteAddr, sentUsername)
+		log.Printf("WARNING %s failed to authenticate as %s", clientIP(r), sentUsername)
 		http.Error(w, "Forbidden", http.StatusForbidden)
 	}
 }
 
+func certificateLogin(w http.ResponseWriter, r *http.Request, username string) {
+	session := getSession(r)
+	renewSession(session)
+
+	session.Values["authenticated"] = true
+	session.Values["username"] = username
+	delete(session.Values, "partialAuth")
+
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Unable to save session: %s", err)
+		return
+	}
+
+	auditAs(r, username, "login-certificate", username, true, "")
+	log.Printf("%s authenticated (certificate) from %s", username, clientIP(r))
+	http.Error(w, "full", http.StatusOK)
+}
+
 func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	session := getSession(r)
-	session.Values = nil
+	session.Options.MaxAge = -1
 
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -293,19 +523,35 @@ func tfaChallengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	provider := config.GetTwoFactorProvider(username)
-	challenge := ""
+	// WebAuthn is preferred but users that also have TOTP set up can fall back to it
+	providers, err := config.GetTwoFactorProviders(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+	provider := ""
+	var challenge interface{} = ""
+
+	if len(providers) != 0 {
+		provider = providers[0]
+	}
 
-	// challenge will be needed for fido2
-	if provider == "totp" {
-		challenge = ""
+	if provider == "webauthn" {
+		options, ok := newAssertionOptions(w, r, username)
+		if !ok {
+			return
+		}
+
+		challenge = options
 	}
 
 	ret := struct {
 		Provider string
-		Challenge string
+		Providers []string
+		Challenge interface{}
 	} {
 		provider,
+		providers,
 		challenge,
 	}
 
@@ -321,10 +567,10 @@ func getAuth(r *http.Request) (string, string) {
 
 func checkAuth(username string, password string) (bool, string) {
 	goodUsername := true
-	user, ok := config.GetUsers()[username]
+	user, err := config.GetUser(username)
 
-	if !ok {
-		log.Printf("Unknown username %s", username)
+	if err != nil {
+		log.Printf("Unable to authenticate %s: %s", username, err)
 
 		// Prevent user enumeration attacks
 		user.Password = "$2a$12$000000000000.0000000000000000000000000000000000000000"
@@ -350,10 +596,22 @@ func getSession(r *http.Request) (*sessions.Session) {
 }
 
 func checkSessionAuthInternal(r *http.Request) (bool) {
+	if _, ok := getRequestToken(r); ok {
+		return true
+	}
+
+	if _, ok := getSocketUser(r); ok {
+		return true
+	}
+
+	if _, ok := getProxyUser(r); ok {
+		return true
+	}
+
 	session := getSession(r)
 
 	if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
-		log.Printf("%s cannot access %s: not authenticated", r.RemoteAddr, r.URL)
+		log.Printf("%s cannot access %s: not authenticated", clientIP(r), r.URL)
 		return false
 	}
 
@@ -375,6 +633,18 @@ func checkSessionAuth(r *http.Request, w http.ResponseWriter) (bool) {
 }
 
 func getUsernameInternal(r *http.Request) (string) {
+	if token, ok := getRequestToken(r); ok {
+		return token.Username
+	}
+
+	if username, ok := getSocketUser(r); ok {
+		return username
+	}
+
+	if username, ok := getProxyUser(r); ok {
+		return username
+	}
+
 	if !checkSessionAuthQuiet(r) {
 		return ""
 	}
@@ -407,18 +677,41 @@ func getPartialAuth(r *http.Request) string {
 	return partial
 }
 
+// Marks the session as fully authenticated once the second factor has been verified. The session gets a new identifier
+// like it does after the first factor so that an identifier seen before the login finished can't be used afterwards.
+func finishTwoFactor(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	renewSession(session)
+
+	delete(session.Values, "partialAuth")
+	session.Values["authenticated"] = true
+
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Unable to save session: %s", err)
+		return false
+	}
+
+	return true
+}
+
 func checkTFAEnabledHandler(w http.ResponseWriter, r *http.Request) {
 	username := getUsernameQuiet(r)
 	if username == "" {
 		return
 	}
 
-	enabled := config.IsTwoFactorEnabled(username)
+	providers, err := config.GetTwoFactorProviders(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
 
 	ret := struct {
 		Enabled bool
+		Providers []string
 	} {
-		enabled,
+		len(providers) != 0,
+		providers,
 	}
 
 	EncodeAndSend(w, ret)
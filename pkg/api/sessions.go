@@ -0,0 +1,300 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Sessions that haven't been used in this long are not touched again on every request
+const sessionTouchInterval = time.Minute
+
+// Stores sessions in the database so that they can be listed and revoked. The cookie only contains a signed random
+// identifier. Sessions expire once they haven't been used for Idle or once they are older than Lifetime.
+type SessionStore struct {
+	Options  *sessions.Options
+	Idle     time.Duration
+	Lifetime time.Duration
+
+	codec *securecookie.SecureCookie
+}
+
+// Returned when listing sessions
+type SessionInfo struct {
+	ID        string
+	IP        string
+	UserAgent string
+	Created   int64
+	LastSeen  int64
+	Current   bool
+}
+
+func NewSessionStore(key []byte, idle time.Duration, lifetime time.Duration) *SessionStore {
+	codec := securecookie.New(key, nil)
+	codec.MaxAge(int(lifetime.Seconds()))
+
+	return &SessionStore {
+		Options:  &sessions.Options{},
+		Idle:     idle,
+		Lifetime: lifetime,
+		codec:    codec,
+	}
+}
+
+func SetupSessions(r *mux.Router) {
+	r.HandleFunc("/api/v0/sessions", requireSession(listSessionsHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/sessions/{id}/revoke", requireSession(revokeSessionHandler)).Methods("POST")
+
+	r.HandleFunc("/api/v0/users/{username}/sessions", requireAdmin(listUserSessionsHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/users/{username}/sessions/revoke", requireAdmin(revokeUserSessionsHandler)).Methods("POST")
+}
+
+// Only the hash of a session's identifier is stored so a copy of the database can't be used to hijack sessions
+func hashSessionID(id string) string {
+	return crypto.HashToken(id)
+}
+
+func (s *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := s.codec.Decode(name, cookie.Value, &id); err != nil {
+		return session, err
+	}
+
+	stored, ok := config.GetSession(hashSessionID(id))
+	if !ok {
+		return session, nil
+	}
+
+	now := time.Now()
+	if s.expired(stored, now) {
+		config.DeleteSession(stored.ID)
+		return session, nil
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(stored.Data)).Decode(&session.Values); err != nil {
+		return session, err
+	}
+
+	session.ID = id
+	session.IsNew = false
+
+	if now.Sub(time.Unix(stored.LastSeen, 0)) > sessionTouchInterval {
+		config.TouchSession(stored.ID, now.Unix())
+	}
+
+	return session, nil
+}
+
+// Saves the session and sets the session cookie. A negative MaxAge deletes the session. Sessions are only stored once
+// the first factor has succeeded so that failed or anonymous requests can't fill the database.
+func (s *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if username, _ := session.Values["username"].(string); username == "" {
+		session.Options.MaxAge = -1
+	}
+
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			config.DeleteSession(hashSessionID(session.ID))
+			session.ID = ""
+		}
+
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	now := time.Now()
+	stored := structs.Session {
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Created:   now.Unix(),
+	}
+
+	if session.ID != "" {
+		if existing, ok := config.GetSession(hashSessionID(session.ID)); ok {
+			stored = existing
+		}
+	} else {
+		session.ID = crypto.GetRandom(32)
+
+		// New sessions are rare enough that this is a convenient time to forget about expired ones
+		config.PruneSessions(now.Add(-s.Idle).Unix(), now.Add(-s.Lifetime).Unix())
+	}
+
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(session.Values); err != nil {
+		return err
+	}
+
+	stored.ID = hashSessionID(session.ID)
+	stored.Username, _ = session.Values["username"].(string)
+	stored.Data = data.Bytes()
+	stored.LastSeen = now.Unix()
+
+	if err := config.SaveSession(stored); err != nil {
+		return err
+	}
+
+	encoded, err := s.codec.Encode(session.Name(), session.ID)
+	if err != nil {
+		return err
+	}
+
+	// Requests forwarded over HTTPS by a trusted proxy also get secure cookies
+	options := *session.Options
+	options.MaxAge = int(s.Lifetime.Seconds())
+	options.Secure = options.Secure || requestScheme(r) == "https"
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, &options))
+
+	return nil
+}
+
+func (s *SessionStore) expired(stored structs.Session, now time.Time) bool {
+	idle := now.Sub(time.Unix(stored.LastSeen, 0)) > s.Idle
+	old := now.Sub(time.Unix(stored.Created, 0)) > s.Lifetime
+
+	return idle || old
+}
+
+// Gives the session a new identifier when it is next saved. Used when logging in to prevent session fixation.
+func renewSession(session *sessions.Session) {
+	if session.ID != "" {
+		config.DeleteSession(hashSessionID(session.ID))
+	}
+
+	session.ID = ""
+}
+
+// Returns the stored ID of the session that the request was made with
+func currentSessionID(r *http.Request) string {
+	session := getSession(r)
+	if session.ID == "" {
+		return ""
+	}
+
+	return hashSessionID(session.ID)
+}
+
+func getSessionInfo(r *http.Request, username string) ([]SessionInfo, error) {
+	current := currentSessionID(r)
+	list := make([]SessionInfo, 0)
+
+	sessions, err := config.GetSessions(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, session := range sessions {
+		list = append(list, SessionInfo {
+			ID:        session.ID,
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			Created:   session.Created,
+			LastSeen:  session.LastSeen,
+			Current:   session.ID == current,
+		})
+	}
+
+	return list, nil
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	list, err := getSessionInfo(r, getUsernameQuiet(r))
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, list)
+}
+
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+
+	if ok, err := config.RevokeSession(username, mux.Vars(r)["id"]); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "revoke-session", username, true, "")
+	log.Printf("%s revoked one of their sessions", username)
+	http.Error(w, "OK", http.StatusOK)
+}
+
+func listUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	list, err := getSessionInfo(r, username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, list)
+}
+
+// Revokes the session given in the ID parameter or every session if no ID is given
+func revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if id, ok := GetParameter(r, "ID"); ok {
+		if ok, err := config.RevokeSession(username, id); err != nil {
+			ReportDatabaseError(w, err)
+			return
+		} else if !ok {
+			http.Error(w, "Unknown session", http.StatusNotFound)
+			return
+		}
+
+		audit(r, "revoke-session", username, true, "")
+		log.Printf("%s revoked a session belonging to %s", admin, username)
+
+	} else {
+		if err := config.RevokeSessions(username, ""); err != nil {
+			ReportDatabaseError(w, err)
+			return
+		}
+
+		audit(r, "revoke-sessions", username, true, "")
+		log.Printf("%s revoked all sessions belonging to %s", admin, username)
+	}
+
+	http.Error(w, "OK", http.StatusOK)
+}
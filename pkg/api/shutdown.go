@@ -0,0 +1,105 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/notifications"
+)
+
+// Runs serve in the background and reports any error other than the server being shut down on errs
+func serveBackground(errs chan<- error, serve func() error) {
+	go func() {
+		if err := serve(); err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+}
+
+// Blocks until SIGINT or SIGTERM is received and then shuts down. SIGHUP reloads the configuration.
+func waitForShutdown(errs <-chan error, servers []*http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case err := <-errs:
+			log.Fatalf("Unable to serve: %s", err)
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				ReloadConfig()
+				continue
+			}
+
+			log.Printf("Received %s, shutting down", sig)
+			SystemdNotify("STOPPING=1")
+			shutdown(servers)
+			return
+		}
+	}
+}
+
+// Stops accepting connections, waits for running requests to finish (up to server.shutdown_timeout) and then closes
+// everything that needs to be closed cleanly
+func shutdown(servers []*http.Server) {
+	timeout, err := time.ParseDuration(config.GetString("server.shutdown_timeout", "30s"))
+	if err != nil {
+		log.Printf("Invalid server.shutdown_timeout, using 30s: %s", err)
+		timeout = 30 * time.Second
+	}
+
+	// Close doesn't wait for handlers to return so some may still be using syslog and the database. They are left open
+	// and SQLite recovers anything that wasn't finished when the process exits.
+	if !ShutdownServers(servers, timeout) {
+		log.Printf("Not closing the database since requests may still be using it")
+	} else {
+		notifications.Close()
+		config.Close()
+	}
+
+	log.Printf("Shutdown complete")
+}
+
+// Stops accepting connections and waits up to timeout for running requests to finish. Returns false if requests were
+// still running after the timeout and had to be cut off by closing the servers.
+func ShutdownServers(servers []*http.Server, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	finished := true
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Requests were still running after %s: %s", timeout, err)
+			srv.Close()
+			finished = false
+		}
+	}
+
+	return finished
+}
+
+// Reloads settings that are only read at startup (used for SIGHUP). Settings that are read from the database on every
+// request take effect without a reload. If any setting is invalid, the previous value is kept.
+func ReloadConfig() {
+	log.Printf("Reloading configuration")
+	SystemdNotify("RELOADING=1")
+	defer SystemdNotify("READY=1")
+
+	if err := setupProxies(); err != nil {
+		log.Printf("Unable to reload proxy configuration: %s", err)
+	}
+
+	if err := setupSSO(); err != nil {
+		log.Printf("Unable to reload single sign on configuration: %s", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+
+	"github.com/gorilla/mux"
+)
+
+const contextPeer = contextKey("peer")
+
+func SetupSocketUsers(r *mux.Router) {
+	r.HandleFunc("/api/v0/socket/users", requireAdmin(listSocketUsersHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/socket/users", requireAdmin(addSocketUserHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/socket/users/delete", requireAdmin(deleteSocketUserHandler)).Methods("POST")
+}
+
+// Opens the Unix socket configured in socket.path, or returns nil if no path is set. Any existing socket at the path
+// is removed first since it can only be left over from a previous run.
+func listenSocket() net.Listener {
+	path := config.GetString("socket.path", "")
+	if path == "" {
+		return nil
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode() & os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	mode, err := strconv.ParseUint(config.GetString("socket.mode", "0660"), 8, 32)
+	if err != nil {
+		log.Fatalf("Invalid socket.mode: %s", err)
+	}
+
+	// The socket is created with the umask applied and only opened up below, so nobody else can connect before then
+	old := syscall.Umask(0177)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(old)
+
+	if err != nil {
+		log.Fatalf("Unable to listen on %s: %s", path, err)
+	}
+
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		log.Fatalf("Unable to set permissions of %s: %s", path, err)
+	}
+
+	if owner := config.GetString("socket.owner", ""); owner != "" {
+		uid, gid := lookupOwner(owner)
+
+		if err := os.Chown(path, uid, gid); err != nil {
+			log.Fatalf("Unable to change owner of %s: %s", path, err)
+		}
+	}
+
+	return listener
+}
+
+// Resolves an owner in the format "user" or "user:group" (names or numeric IDs) as accepted by chown. A missing part
+// is returned as -1 so that it isn't changed.
+func lookupOwner(owner string) (int, int) {
+	uid, gid := -1, -1
+	parts := strings.SplitN(owner, ":", 2)
+
+	if parts[0] != "" {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			u, err = user.LookupId(parts[0])
+		}
+		if err != nil {
+			log.Fatalf("Unknown socket owner %s", parts[0])
+		}
+
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			g, err = user.LookupGroupId(parts[1])
+		}
+		if err != nil {
+			log.Fatalf("Unknown socket group %s", parts[1])
+		}
+
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	return uid, gid
+}
+
+// Saves the credentials of the process on the other end of Unix socket connections in the connection's context.
+// Used as http.Server.ConnContext.
+func PeerContext(ctx context.Context, c net.Conn) context.Context {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		log.Printf("Unable to get Unix socket peer credentials: %v %v", err, credErr)
+		return ctx
+	}
+
+	return context.WithValue(ctx, contextPeer, cred.Uid)
+}
+
+// Returns the local user ID of the process that made the request over the Unix socket
+func getPeerUID(r *http.Request) (uint32, bool) {
+	uid, ok := r.Context().Value(contextPeer).(uint32)
+	return uid, ok
+}
+
+// Returns the user that the request's Unix socket peer is mapped to
+func getSocketUser(r *http.Request) (string, bool) {
+	uid, ok := getPeerUID(r)
+	if !ok {
+		return "", false
+	}
+
+	username, ok := config.GetSocketUser(uid)
+	if !ok || !config.IsUser(username) {
+		return "", false
+	}
+
+	return username, true
+}
+
+func listSocketUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := config.GetSocketUsers()
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, users)
+}
+
+func addSocketUserHandler(w http.ResponseWriter, r *http.Request) {
+	rawUID, okUID := GetParameter(r, "UID")
+	username, okUsername := GetParameter(r, "Username")
+	if !okUID || !okUsername {
+		ReportMissing(w)
+		return
+	}
+
+	uid, err := strconv.ParseUint(rawUID, 10, 32)
+	if err != nil {
+		ReportInvalid(w)
+		return
+	}
+
+	if !config.IsUser(username) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+
+	if err := config.SetSocketUser(uint32(uid), username); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "add-socket-user", username, true, "")
+	log.Printf("%s mapped local user ID %d to %s", getUsernameQuiet(r), uid, username)
+	http.Error(w, "OK", http.StatusOK)
+}
+
+func deleteSocketUserHandler(w http.ResponseWriter, r *http.Request) {
+	rawUID, ok := GetParameter(r, "UID")
+	if !ok {
+		ReportMissing(w)
+		return
+	}
+
+	uid, err := strconv.ParseUint(rawUID, 10, 32)
+	if err != nil {
+		ReportInvalid(w)
+		return
+	}
+
+	if ok, err := config.DeleteSocketUser(uint32(uid)); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, "Unknown local user", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "delete-socket-user", rawUID, true, "")
+	log.Printf("%s removed the mapping for local user ID %d", getUsernameQuiet(r), uid)
+	http.Error(w, "OK", http.StatusOK)
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+// Header set by a single sign on proxy to the name of the logged in user. Empty if single sign on is disabled.
+// Protected by proxyLock since it is replaced when the configuration is reloaded.
+var ssoHeader string
+
+func setupSSO() error {
+	header := config.GetString("proxy.auth_header", "")
+
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+
+	if header != "" {
+		if len(trustedProxies) == 0 {
+			return errors.New("proxy.auth_header is set but proxy.trusted is empty")
+		}
+
+		if role := config.GetString("proxy.default_role", structs.RoleViewer); !structs.IsRole(role) {
+			return fmt.Errorf("invalid value %s for proxy.default_role", role)
+		}
+
+		log.Printf("Authenticating users from the %s header set by trusted proxies", header)
+	}
+
+	ssoHeader = header
+
+	return nil
+}
+
+// Returns the user named in the single sign on header. The header is only believed if the request was made by a
+// trusted proxy, which must remove the header from requests it receives. Unknown users are created if
+// proxy.auto_provision is enabled.
+func getProxyUser(r *http.Request) (string, bool) {
+	proxyLock.RLock()
+	header := ssoHeader
+	proxyLock.RUnlock()
+
+	if header == "" || !isTrustedProxy(remoteIP(r)) {
+		return "", false
+	}
+
+	username := r.Header.Get(header)
+	if username == "" || strings.ContainsAny(username, " \t\r\n") {
+		return "", false
+	}
+
+	if config.IsUser(username) {
+		return username, true
+	}
+
+	if !config.GetBool("proxy.auto_provision", false) {
+		log.Printf("%s cannot access %s: unknown single sign on user %s", clientIP(r), r.URL, username)
+		return "", false
+	}
+
+	// The password is random and never revealed since these users always log in through the proxy
+	role := config.GetString("proxy.default_role", structs.RoleViewer)
+	if err := config.CreateUser(username, crypto.HashPassword(crypto.GetRandom(32)), role, nil); err != nil {
+		log.Printf("Unable to create single sign on user %s: %s", username, err)
+		return "", false
+	}
+
+	auditAs(r, username, "provision-user", username, true, "")
+	log.Printf("Created single sign on user %s with role %s", username, role)
+
+	return username, true
+}
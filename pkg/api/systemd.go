@@ -0,0 +1,125 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// First file descriptor passed by systemd socket activation (sd_listen_fds(3)). Tests change it to a descriptor they
+// opened themselves.
+var ListenFdsStart = 3
+
+// Returns the listeners passed by systemd socket activation, if any. The environment variables are cleared so that
+// child processes don't also try to use them.
+func SystemdListeners() []net.Listener {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make([]net.Listener, 0, count)
+
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(ListenFdsStart + i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(ListenFdsStart + i), name)
+
+		listener, err := net.FileListener(file)
+		if err != nil {
+			log.Fatalf("Unable to use socket %s passed by systemd: %s", name, err)
+		}
+
+		// FileListener duplicates the descriptor so the original is no longer needed
+		file.Close()
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
+// Sends state to the service manager (sd_notify(3)). Does nothing if Lifeguard wasn't started by systemd with
+// Type=notify.
+func SystemdNotify(state string) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return
+	}
+
+	// Abstract sockets are given with a leading @
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr { Name: path, Net: "unixgram" })
+	if err != nil {
+		log.Printf("Unable to notify systemd: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Unable to notify systemd: %s", err)
+	}
+}
+
+// Returns how often the watchdog must be pinged, or zero if the watchdog isn't enabled
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the systemd watchdog for as long as the readiness checks used by /readyz pass. If they fail, pings stop and
+// systemd restarts the service once WatchdogSec passes.
+func watchdog() {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	// Ping twice per interval as recommended by sd_watchdog_enabled(3)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		// Checks that hang would otherwise delay the next ping past the deadline without being reported
+		ctx, cancel := context.WithTimeout(context.Background(), interval / 2)
+		report := runReadinessChecks(ctx)
+		cancel()
+
+		if report.Status != healthOK {
+			log.Printf("Readiness checks failed, not notifying watchdog")
+			continue
+		}
+
+		SystemdNotify("WATCHDOG=1")
+	}
+}
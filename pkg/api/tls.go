@@ -0,0 +1,237 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+)
+
+// How often the certificate files are checked for changes. Tests shorten it.
+var CertCheckInterval = 10 * time.Second
+
+// Lifetime of generated certificates
+const selfSignedLifetime = 825 * 24 * time.Hour
+
+// Serves the certificate from certFile and keyFile and reloads it when either file changes, so a renewed certificate
+// is used without restarting Lifeguard.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	modified  time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	reloader := &CertReloader {
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// Returns the newest modification time of the certificate and key
+func (c *CertReloader) modTime() time.Time {
+	var newest time.Time
+
+	for _, path := range []string { c.certFile, c.keyFile } {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest
+}
+
+func (c *CertReloader) load() error {
+	modified := c.modTime()
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modified = modified
+
+	log.Printf("Loaded TLS certificate %s with SHA-256 fingerprint %s", c.certFile, Fingerprint(cert.Certificate[0]))
+
+	return nil
+}
+
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.lastCheck) < CertCheckInterval {
+		return c.cert, nil
+	}
+
+	c.lastCheck = time.Now()
+
+	// If the new certificate can't be loaded (for example if only one of the files has been replaced so far), keep
+	// serving the old one
+	if c.modTime().After(c.modified) {
+		if err := c.load(); err != nil {
+			log.Printf("Unable to reload TLS certificate: %s", err)
+		}
+	}
+
+	return c.cert, nil
+}
+
+// Formats the SHA-256 hash of a DER encoded certificate the same way as browsers and openssl
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	var pairs []string
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i + 2])
+	}
+
+	return strings.Join(pairs, ":")
+}
+
+// Creates a self signed certificate for this host if certFile or keyFile don't exist
+func EnsureCertificate(certFile string, keyFile string) error {
+	_, errCert := os.Stat(certFile)
+	_, errKey := os.Stat(keyFile)
+	if errCert == nil && errKey == nil {
+		return nil
+	} else if !os.IsNotExist(errCert) && errCert != nil {
+		return errCert
+	} else if !os.IsNotExist(errKey) && errKey != nil {
+		return errKey
+	}
+
+	log.Printf("Generating self signed TLS certificate %s", certFile)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	hostname, _ := os.Hostname()
+	names := []string { "localhost" }
+	if hostname != "" {
+		names = append(names, hostname)
+	}
+
+	template := x509.Certificate {
+		SerialNumber:          serial,
+		Subject:               pkix.Name { CommonName: names[len(names) - 1], Organization: []string { "Lifeguard" } },
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage { x509.ExtKeyUsageServerAuth },
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           []net.IP { net.IPv4(127, 0, 0, 1), net.IPv6loopback },
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block { Type: "CERTIFICATE", Bytes: der })
+	keyPem := pem.EncodeToMemory(&pem.Block { Type: "EC PRIVATE KEY", Bytes: rawKey })
+
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(certFile, certPem, 0644)
+}
+
+// Returns the TLS configuration to serve with, or nil if TLS is disabled
+func setupTLS() *tls.Config {
+	if !config.GetBool("tls.enabled", false) {
+		return nil
+	}
+
+	certFile := config.GetString("tls.cert", "./config/tls.crt")
+	keyFile := config.GetString("tls.key", "./config/tls.key")
+
+	if err := EnsureCertificate(certFile, keyFile); err != nil {
+		log.Fatalf("Unable to create TLS certificate: %s", err)
+	}
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("Unable to load TLS certificate: %s", err)
+	}
+
+	tlsConfig := &tls.Config {
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	setupClientAuth(tlsConfig)
+
+	return tlsConfig
+}
+
+// Returns a server for bind that redirects every request to the same URL over HTTPS on the port that port is bound to
+func newRedirectServer(bind string, port string) *http.Server {
+	_, tlsPort, _ := net.SplitHostPort(port)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("https://%s%s", host, r.URL.RequestURI()), http.StatusMovedPermanently)
+	})
+
+	return &http.Server {
+		Handler:      handler,
+		Addr:         bind,
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+	}
+}
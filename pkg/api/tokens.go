@@ -0,0 +1,202 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/gorilla/mux"
+)
+
+type contextKey string
+
+const contextToken = contextKey("token")
+
+// All tokens start with this prefix so they are easy to identify (for example by secret scanners)
+const tokenPrefix = "lg_"
+
+func SetupTokens(r *mux.Router) {
+	r.HandleFunc("/api/v0/tokens", requireSession(listTokensHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/tokens/create", requireSession(createTokenHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/tokens/{token}/revoke", requireSession(revokeTokenHandler)).Methods("POST")
+}
+
+// Authenticates requests with an "Authorization: Bearer" header. Requests with an invalid token are rejected instead of
+// falling back to the session so that scripts get a clear error.
+func tokenAuthMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := lookupToken(strings.TrimPrefix(header, "Bearer "))
+		if !strings.HasPrefix(header, "Bearer ") || !ok {
+			log.Printf("%s cannot access %s: invalid API token", clientIP(r), r.URL)
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextToken, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns the API token that the request was authenticated with
+func getRequestToken(r *http.Request) (structs.Token, bool) {
+	token, ok := r.Context().Value(contextToken).(structs.Token)
+	return token, ok
+}
+
+// Wraps handler so it can only be used by authenticated users and not with an API token. This prevents a token from
+// being used to create other tokens with more permissions or to take over the account.
+func requireSession(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := getRequestToken(r); ok {
+			http.Error(w, "This action is not available to API tokens", http.StatusForbidden)
+			return
+		}
+
+		if getUsername(r, w) == "" {
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// Validates a token in the format "lg_id_secret" and updates the last time it was used
+func lookupToken(raw string) (structs.Token, bool) {
+	parts := strings.Split(strings.TrimPrefix(raw, tokenPrefix), "_")
+	if !strings.HasPrefix(raw, tokenPrefix) || len(parts) != 2 {
+		return structs.Token { }, false
+	}
+
+	token, hash, ok := config.GetToken(parts[0])
+	if !ok || !crypto.TokensEqual(hash, crypto.HashToken(parts[1])) {
+		return structs.Token { }, false
+	}
+
+	now := time.Now().Unix()
+	if token.Expires != 0 && now > token.Expires {
+		return structs.Token { }, false
+	}
+
+	token.LastUsed = now
+	config.SetTokenLastUsed(token.ID, now)
+
+	return token, true
+}
+
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	tokens, err := config.GetTokens(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, tokens)
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	name, okName := GetParameter(r, "Name")
+	rawScopes, okScopes := GetParameter(r, "Scopes")
+	if !okName || !okScopes {
+		ReportMissing(w)
+		return
+	}
+
+	// Tokens can only be granted permissions that exist. They are further limited by the user's role when used.
+	scopes := strings.Split(rawScopes, ",")
+	for _, scope := range scopes {
+		if !structs.RoleHasPermission(structs.RoleAdmin, scope) {
+			http.Error(w, "Unknown scope " + scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Expiration is optional and specified in days
+	var expires int64
+	if raw, ok := GetParameter(r, "Expires"); ok {
+		days := atoiDefault(raw)
+		if days <= 0 {
+			http.Error(w, "Invalid expiration", http.StatusBadRequest)
+			return
+		}
+
+		expires = time.Now().AddDate(0, 0, days).Unix()
+	}
+
+	token := structs.Token {
+		ID:       crypto.GetRandom(8),
+		Username: username,
+		Name:     name,
+		Scopes:   scopes,
+		Created:  time.Now().Unix(),
+		Expires:  expires,
+	}
+	secret := crypto.GetRandom(32)
+
+	if err := config.SaveToken(token, crypto.HashToken(secret)); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "create-token", token.ID, true, "")
+	log.Printf("%s created API token %s (%s) with scopes %v", username, token.ID, name, scopes)
+
+	ret := struct {
+		Token string
+		Info  structs.Token
+	} {
+		tokenPrefix + token.ID + "_" + secret,
+		token,
+	}
+
+	EncodeAndSend(w, ret)
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	id, ok := GetParameter(r, "token")
+	if !ok {
+		ReportMissing(w)
+		return
+	}
+
+	if ok, err := config.RevokeToken(username, id); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, "Unknown token", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "revoke-token", id, true, "")
+	log.Printf("%s revoked API token %s", username, id)
+	http.Error(w, "", http.StatusOK)
+}
@@ -5,7 +5,6 @@ package api
 
 import (
 	"net/http"
-	"log"
 
 	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 	
@@ -13,8 +12,8 @@ import (
 )
 
 func SetupTOTP(r *mux.Router) {
-	r.HandleFunc("/api/v0/tfa/totp/initialize", initializeHandler).Methods("GET")
-	r.HandleFunc("/api/v0/tfa/totp/save", saveHandler).Methods("POST")
+	r.HandleFunc("/api/v0/tfa/totp/initialize", requireSession(initializeHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/tfa/totp/save", requireSession(saveHandler)).Methods("POST")
 	r.HandleFunc("/api/v0/tfa/totp/authenticate", challengeHandler).Methods("POST")
 }
 
@@ -56,13 +55,31 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ok := config.SaveTOTP(username, secret, code)
-	if !ok {
+	ok, err := config.SaveTOTP(username, secret, code)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
 		http.Error(w, "Invalid code - check that the time is in sync on the server and your phone", http.StatusBadRequest)
 		return
 	}
 
-	http.Error(w, "OK", http.StatusOK)
+	audit(r, "enable-totp", username, true, "")
+
+	// Without recovery codes, losing the phone means that only root on the server can disable 2FA
+	codes, err := generateRecoveryCodes(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	ret := struct {
+		Codes []string
+	} {
+		codes,
+	}
+
+	EncodeAndSend(w, ret)
 }
 
 func challengeHandler(w http.ResponseWriter, r *http.Request) {
@@ -73,22 +90,41 @@ func challengeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !allowAttempt(w, r, username) {
+		return
+	}
+
 	code, codeOk := GetParameter(r, "code")
 	if !codeOk {
 		ReportMissing(w)
 		return
 	}
 
-	ok := config.VerifyTOTP(username, code)
-	if !ok {
+	// Recovery codes are accepted in place of a TOTP code. TOTP codes are only checked for users that set up TOTP so
+	// they can't be used to skip WebAuthn.
+	ok := false
+	var err error
+
+	if len(code) != 6 {
+		ok, err = useRecoveryCode(username, code)
+	} else if provider, providerErr := config.GetTwoFactorProvider(username); providerErr != nil {
+		err = providerErr
+	} else if provider == "totp" {
+		ok, err = config.VerifyTOTP(username, code)
+	}
+
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		recordFailure(r, username)
 		http.Error(w, "Invalid code", http.StatusForbidden)
 		return
 	}
 
-	session.Values["authenticated"] = true
-	if err := session.Save(r, w); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("Unable to save session: %s", err)
+	recordSuccess(r, username)
+
+	if !finishTwoFactor(w, r, session) {
 		return
 	}
 
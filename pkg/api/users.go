@@ -0,0 +1,321 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/gorilla/mux"
+)
+
+const minPasswordLength = 8
+
+// Information about a user that is safe to send to administrators
+type UserInfo struct {
+	Username         string
+	Role             string
+	TwoFactorEnabled bool
+	Scopes           []string
+}
+
+func SetupUsers(r *mux.Router) {
+	// Administration
+	r.HandleFunc("/api/v0/users", requireAdmin(listUsersHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/users/create", requireAdmin(createUserHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/users/{username}/delete", requireAdmin(deleteUserHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/users/{username}/password", requireAdmin(resetPasswordHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/users/{username}/tfa/disable", requireAdmin(disableTwoFactorHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/users/{username}/role", requireAdmin(setRoleHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/users/{username}/scopes", requireAdmin(setScopesHandler)).Methods("POST")
+
+	// Self service
+	r.HandleFunc("/api/v0/account/password", requireSession(changePasswordHandler)).Methods("POST")
+}
+
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users := make([]UserInfo, 0)
+
+	all, err := config.GetUsers()
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	for _, user := range all {
+		twoFactor, err := config.IsTwoFactorEnabled(user.Username)
+		if err != nil {
+			ReportDatabaseError(w, err)
+			return
+		}
+
+		scopes, err := config.GetScopes(user.Username)
+		if err != nil {
+			ReportDatabaseError(w, err)
+			return
+		}
+
+		users = append(users, UserInfo {
+			Username:         user.Username,
+			Role:             user.Role,
+			TwoFactorEnabled: twoFactor,
+			Scopes:           scopes,
+		})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+
+	EncodeAndSend(w, users)
+}
+
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, okUsername := GetParameter(r, "Username")
+	password, okPassword := GetParameter(r, "Password")
+	role, okRole := GetParameter(r, "Role")
+	if !okUsername || !okPassword || !okRole {
+		ReportMissing(w)
+		return
+	}
+
+	if strings.TrimSpace(username) != username || strings.ContainsAny(username, " \t\r\n") {
+		http.Error(w, "Usernames cannot contain whitespace", http.StatusBadRequest)
+		return
+	} else if config.IsUser(username) {
+		http.Error(w, "User already exists", http.StatusConflict)
+		return
+	} else if !structs.IsRole(role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	} else if !checkPasswordLength(w, password) {
+		return
+	}
+
+	if err := config.CreateUser(username, crypto.HashPassword(password), role, nil); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "create-user", username, true, "")
+	log.Printf("%s created user %s with role %s", admin, username, role)
+	http.Error(w, "", http.StatusOK)
+}
+
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if username == admin {
+		http.Error(w, "You cannot delete your own account", http.StatusBadRequest)
+		return
+	}
+
+	if err := config.DeleteUser(username); errors.Is(err, config.ErrLastAdmin) {
+		http.Error(w, "You cannot delete the last administrator", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "delete-user", username, true, "")
+	log.Printf("%s deleted user %s", admin, username)
+	http.Error(w, "", http.StatusOK)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	// Changing your own password requires the current one
+	if username == admin {
+		http.Error(w, "Use /api/v0/account/password to change your own password", http.StatusBadRequest)
+		return
+	}
+
+	password, okPassword := GetParameter(r, "Password")
+	if !okPassword {
+		ReportMissing(w)
+		return
+	} else if !checkPasswordLength(w, password) {
+		return
+	}
+
+	if err := config.SetPassword(username, crypto.HashPassword(password)); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	if err := config.RevokeSessions(username, ""); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "reset-password", username, true, "")
+	log.Printf("%s reset the password for %s", admin, username)
+	http.Error(w, "", http.StatusOK)
+}
+
+func disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	if err := config.DisableTwoFactor(username); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "disable-2fa", username, true, "")
+	log.Printf("%s disabled two factor for %s", admin, username)
+	http.Error(w, "", http.StatusOK)
+}
+
+func setRoleHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	role, okRole := GetParameter(r, "Role")
+	if !okRole {
+		ReportMissing(w)
+		return
+	} else if !structs.IsRole(role) {
+		http.Error(w, "Unknown role", http.StatusBadRequest)
+		return
+	}
+
+	// Prevent administrators from accidentally locking everyone out of user management
+	if username == admin && role != structs.RoleAdmin {
+		http.Error(w, "You cannot remove your own administrator role", http.StatusBadRequest)
+		return
+	}
+
+	if err := config.SetRole(username, role); errors.Is(err, config.ErrLastAdmin) {
+		http.Error(w, "You cannot remove the role of the last administrator", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "set-role", username, true, "")
+	log.Printf("%s changed the role of %s to %s", admin, username, role)
+	http.Error(w, "", http.StatusOK)
+}
+
+func setScopesHandler(w http.ResponseWriter, r *http.Request) {
+	admin := getUsernameQuiet(r)
+
+	username, ok := getTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	// An empty list of scopes is valid and removes all restrictions
+	raw, _ := GetParameter(r, "Scopes")
+
+	var scopes []string
+	for _, scope := range strings.Split(raw, ",") {
+		if scope = strings.Trim(scope, " /"); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	if err := config.SetScopes(username, scopes); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "set-scopes", username, true, "")
+	log.Printf("%s limited %s to %v", admin, username, scopes)
+	http.Error(w, "", http.StatusOK)
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsername(r, w)
+	if username == "" {
+		return
+	}
+
+	current, okCurrent := GetParameter(r, "Current")
+	password, okPassword := GetParameter(r, "Password")
+	if !okCurrent || !okPassword {
+		ReportMissing(w)
+		return
+	}
+
+	if auth, _ := checkAuth(username, current); !auth {
+		audit(r, "change-password", username, false, "")
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	} else if !checkPasswordLength(w, password) {
+		return
+	}
+
+	if err := config.SetPassword(username, crypto.HashPassword(password)); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	// Anyone else logged in with the old password is logged out
+	if err := config.RevokeSessions(username, currentSessionID(r)); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "change-password", username, true, "")
+	log.Printf("%s changed their password", username)
+	http.Error(w, "", http.StatusOK)
+}
+
+// Returns the user named in the URL if they exist
+func getTargetUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	username, ok := GetParameter(r, "username")
+	if !ok {
+		ReportMissing(w)
+		return "", false
+	}
+
+	if !config.IsUser(username) {
+		http.Error(w, "Unknown user", http.StatusNotFound)
+		return "", false
+	}
+
+	return username, true
+}
+
+func checkPasswordLength(w http.ResponseWriter, password string) bool {
+	if len(password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Passwords must be at least %d characters long", minPasswordLength), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
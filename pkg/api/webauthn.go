@@ -0,0 +1,367 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package api
+
+import (
+	"crypto/rand"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/webauthn"
+
+	"github.com/gorilla/mux"
+)
+
+// How long the browser should wait for the user to interact with their authenticator, in milliseconds
+const webauthnTimeout = 60000
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func SetupWebAuthn(r *mux.Router) {
+	r.HandleFunc("/api/v0/tfa/webauthn/credentials", requireSession(listCredentialsHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/tfa/webauthn/credentials/{id}/delete", requireSession(deleteCredentialHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/tfa/webauthn/register", requireSession(beginRegistrationHandler)).Methods("GET")
+	r.HandleFunc("/api/v0/tfa/webauthn/register", requireSession(finishRegistrationHandler)).Methods("POST")
+	r.HandleFunc("/api/v0/tfa/webauthn/authenticate", webauthnChallengeHandler).Methods("POST")
+}
+
+// Returns the relying party ID and the origin that the browser will report. They are never derived from the request
+// since the Host header is controlled by the client. The ID defaults to the host of webauthn.origin. If the origin
+// isn't configured, an error is sent and false is returned.
+func relyingParty(w http.ResponseWriter) (string, string, bool) {
+	origin := strings.TrimSuffix(config.GetString("webauthn.origin", ""), "/")
+
+	parsed, err := url.Parse(origin)
+	if origin == "" || err != nil || parsed.Hostname() == "" {
+		log.Printf("WebAuthn requires webauthn.origin to be set to the URL of the web UI (such as https://nas.example.com)")
+		http.Error(w, "WebAuthn is not configured", http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	rpID := config.GetString("webauthn.rpid", "")
+	if rpID == "" {
+		rpID = parsed.Hostname()
+	}
+
+	return rpID, origin, true
+}
+
+// Generates a new challenge and saves it in the session so the response can be verified
+func newWebAuthnChallenge(w http.ResponseWriter, r *http.Request) (string, bool) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		http.Error(w, "Unable to generate challenge", http.StatusInternalServerError)
+		log.Printf("Unable to generate WebAuthn challenge: %s", err)
+		return "", false
+	}
+
+	encoded := webauthn.Encode(challenge)
+
+	session := getSession(r)
+	session.Values["webauthnChallenge"] = encoded
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Unable to save session: %s", err)
+		return "", false
+	}
+
+	return encoded, true
+}
+
+// Returns the challenge saved by newWebAuthnChallenge and removes it from the session so it can only be used once.
+// The session must be saved by the caller.
+func takeWebAuthnChallenge(r *http.Request) []byte {
+	session := getSession(r)
+
+	encoded, ok := session.Values["webauthnChallenge"].(string)
+	delete(session.Values, "webauthnChallenge")
+	if !ok {
+		return nil
+	}
+
+	challenge, err := webauthn.Decode(encoded)
+	if err != nil {
+		return nil
+	}
+
+	return challenge
+}
+
+func getCredentialDescriptors(username string) ([]credentialDescriptor, error) {
+	descriptors := make([]credentialDescriptor, 0)
+
+	creds, err := config.GetWebAuthnCredentials(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cred := range creds {
+		descriptors = append(descriptors, credentialDescriptor {
+			Type: "public-key",
+			ID:   cred.ID,
+		})
+	}
+
+	return descriptors, nil
+}
+
+// Returns the options passed to navigator.credentials.get() when completing a login. Binary values are base64url
+// encoded and must be decoded by the web UI.
+func newAssertionOptions(w http.ResponseWriter, r *http.Request, username string) (interface{}, bool) {
+	descriptors, err := getCredentialDescriptors(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return nil, false
+	}
+
+	rpID, _, ok := relyingParty(w)
+	if !ok {
+		return nil, false
+	}
+
+	challenge, ok := newWebAuthnChallenge(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	return map[string]interface{} {
+		"challenge":        challenge,
+		"rpId":             rpID,
+		"timeout":          webauthnTimeout,
+		"allowCredentials": descriptors,
+		"userVerification": "discouraged",
+	}, true
+}
+
+func listCredentialsHandler(w http.ResponseWriter, r *http.Request) {
+	creds, err := config.GetWebAuthnCredentials(getUsernameQuiet(r))
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	EncodeAndSend(w, creds)
+}
+
+func deleteCredentialHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+	id := mux.Vars(r)["id"]
+
+	if ok, err := config.DeleteWebAuthnCredential(username, id); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if !ok {
+		http.Error(w, "Unknown authenticator", http.StatusNotFound)
+		return
+	}
+
+	audit(r, "delete-webauthn", id, true, "")
+	log.Printf("%s removed a WebAuthn authenticator", username)
+	http.Error(w, "OK", http.StatusOK)
+}
+
+// Returns the options passed to navigator.credentials.create() when registering a new authenticator
+func beginRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+
+	descriptors, err := getCredentialDescriptors(username)
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	rpID, _, ok := relyingParty(w)
+	if !ok {
+		return
+	}
+
+	challenge, ok := newWebAuthnChallenge(w, r)
+	if !ok {
+		return
+	}
+
+	params := make([]map[string]interface{}, 0)
+	for _, alg := range webauthn.Algorithms {
+		params = append(params, map[string]interface{} {
+			"type": "public-key",
+			"alg":  alg,
+		})
+	}
+
+	options := map[string]interface{} {
+		"challenge": challenge,
+		"rp": map[string]string {
+			"id":   rpID,
+			"name": "Lifeguard",
+		},
+		"user": map[string]string {
+			"id":          webauthn.Encode([]byte(username)),
+			"name":        username,
+			"displayName": username,
+		},
+		"pubKeyCredParams":   params,
+		"timeout":            webauthnTimeout,
+		"attestation":        "none",
+		"excludeCredentials": descriptors,
+		"authenticatorSelection": map[string]string {
+			"userVerification": "discouraged",
+		},
+	}
+
+	EncodeAndSend(w, options)
+}
+
+func finishRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	username := getUsernameQuiet(r)
+	session := getSession(r)
+
+	name, okName := GetParameter(r, "Name")
+	rawClientData, okClient := GetParameter(r, "ClientData")
+	rawAttestation, okAttestation := GetParameter(r, "AttestationObject")
+	if !okName || !okClient || !okAttestation {
+		ReportMissing(w)
+		return
+	}
+
+	clientData, errClient := webauthn.Decode(rawClientData)
+	attestation, errAttestation := webauthn.Decode(rawAttestation)
+	if errClient != nil || errAttestation != nil {
+		ReportInvalid(w)
+		return
+	}
+
+	challenge := takeWebAuthnChallenge(r)
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Unable to save session: %s", err)
+		return
+	}
+
+	rpID, origin, ok := relyingParty(w)
+	if !ok {
+		return
+	}
+
+	cred, err := webauthn.VerifyRegistration(clientData, attestation, challenge, origin, rpID)
+	if err != nil {
+		log.Printf("%s failed to register a WebAuthn authenticator: %s", username, err)
+		http.Error(w, "Unable to verify authenticator: " + err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := webauthn.Encode(cred.ID)
+	if exists, err := config.IsWebAuthnCredential(id); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	} else if exists {
+		http.Error(w, "Authenticator is already registered", http.StatusConflict)
+		return
+	}
+
+	err = config.SaveWebAuthnCredential(structs.WebAuthnCredential {
+		ID:        id,
+		Username:  username,
+		Name:      name,
+		PublicKey: cred.PublicKey,
+		SignCount: cred.SignCount,
+		Created:   time.Now().Unix(),
+	})
+	if err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+
+	audit(r, "register-webauthn", name, true, "")
+	log.Printf("%s registered WebAuthn authenticator %s", username, name)
+	http.Error(w, "OK", http.StatusOK)
+}
+
+func webauthnChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	session := getSession(r)
+
+	username := getPartialAuth(r)
+	if username == "" {
+		http.Error(w, "Invalid state", http.StatusForbidden)
+		return
+	}
+
+	if !allowAttempt(w, r, username) {
+		return
+	}
+
+	var decoded [4][]byte
+	for i, name := range []string { "CredentialID", "ClientData", "AuthenticatorData", "Signature" } {
+		raw, ok := GetParameter(r, name)
+		if !ok {
+			ReportMissing(w)
+			return
+		}
+
+		value, err := webauthn.Decode(raw)
+		if err != nil {
+			ReportInvalid(w)
+			return
+		}
+
+		decoded[i] = value
+	}
+
+	id, clientData, authData, signature := webauthn.Encode(decoded[0]), decoded[1], decoded[2], decoded[3]
+
+	// Challenges are single use even if verification fails
+	challenge := takeWebAuthnChallenge(r)
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Unable to save session: %s", err)
+		return
+	}
+
+	stored, ok := config.GetWebAuthnCredential(username, id)
+	if !ok {
+		log.Printf("%s failed 2FA challenge: Unknown WebAuthn authenticator", username)
+		recordFailure(r, username)
+		http.Error(w, "Unknown authenticator", http.StatusForbidden)
+		return
+	}
+
+	cred := webauthn.Credential {
+		PublicKey: stored.PublicKey,
+		SignCount: stored.SignCount,
+	}
+
+	rpID, origin, ok := relyingParty(w)
+	if !ok {
+		return
+	}
+
+	count, err := webauthn.VerifyAssertion(cred, clientData, authData, signature, challenge, origin, rpID)
+	if err != nil {
+		log.Printf("%s failed 2FA challenge: %s", username, err)
+		recordFailure(r, username)
+		http.Error(w, "Invalid response", http.StatusForbidden)
+		return
+	}
+
+	// The login can't finish without the new counter, otherwise a cloned authenticator could reuse the old one
+	if err := config.UpdateWebAuthnCredential(id, count, time.Now().Unix()); err != nil {
+		ReportDatabaseError(w, err)
+		return
+	}
+	recordSuccess(r, username)
+
+	if !finishTwoFactor(w, r, session) {
+		return
+	}
+
+	log.Printf("%s authenticated successfully with %s", username, stored.Name)
+	http.Error(w, "OK", http.StatusOK)
+}
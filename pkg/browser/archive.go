@@ -0,0 +1,207 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package browser
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Totals for a directory tree, used to enforce the archive limits before any output is written
+type archiveStats struct {
+	Files int
+	Bytes int64
+}
+
+// Walks the directory at root without writing anything so the archive limits can be enforced before any output starts
+func CheckArchiveLimits(root string, maxFiles int, maxBytes int64) error {
+	stats := archiveStats{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		stats.Files++
+		if info.Mode().IsRegular() {
+			stats.Bytes += info.Size()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if stats.Files > maxFiles {
+		return &Error {
+			Code:    ErrTooLarge,
+			Message: fmt.Sprintf("%s contains %d files which exceeds the limit of %d", root, stats.Files, maxFiles),
+		}
+	}
+
+	if stats.Bytes > maxBytes {
+		return &Error {
+			Code:    ErrTooLarge,
+			Message: fmt.Sprintf("%s contains %d bytes which exceeds the limit of %d", root, stats.Bytes, maxBytes),
+		}
+	}
+
+	log.Printf("Archiving %d files (%d bytes) from %s", stats.Files, stats.Bytes, root)
+	return nil
+}
+
+// Streams the directory at root to w as an archive in the requested format ("tar.gz" or "zip").
+// Symbolic links are stored as links (and never followed) and special files (devices, sockets and FIFOs) are skipped.
+func WriteArchive(w io.Writer, root string, format string) error {
+	// Every entry in the archive is prefixed with the name of the directory being downloaded
+	base := filepath.Dir(root)
+
+	if format == "tar.gz" {
+		return writeTar(w, root, base)
+	} else if format == "zip" {
+		return writeZip(w, root, base)
+	}
+
+	return fmt.Errorf("unknown archive format %s", format)
+}
+
+func writeTar(w io.Writer, root string, base string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, link, ok, err := archiveEntry(path, base, info)
+		if err != nil || !ok {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			return copyFile(tw, path, hdr.Size)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func writeZip(w io.Writer, root string, base string) error {
+	zw := zip.NewWriter(w)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, link, ok, err := archiveEntry(path, base, info)
+		if err != nil || !ok {
+			return err
+		}
+
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = name
+
+		if info.IsDir() {
+			hdr.Name += "/"
+		} else if info.Mode().IsRegular() {
+			hdr.Method = zip.Deflate
+		}
+
+		entry, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			return copyFile(entry, path, info.Size())
+
+		} else if link != "" {
+			// By convention, the contents of a symlink entry in a zip file is the link target
+			_, err := entry.Write([]byte(link))
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// Returns the name to store path under, the target if path is a symlink and false if path should not be archived
+func archiveEntry(path string, base string, info os.FileInfo) (string, string, bool, error) {
+	mode := info.Mode()
+	link := ""
+
+	if mode & (os.ModeDevice | os.ModeCharDevice | os.ModeNamedPipe | os.ModeSocket) != 0 {
+		log.Printf("Skipping special file %s", path)
+		return "", "", false, nil
+	}
+
+	if mode & os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			log.Printf("Skipping unreadable symlink %s: %s", path, err)
+			return "", "", false, nil
+		}
+
+		link = target
+	}
+
+	name, err := filepath.Rel(base, path)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	return strings.TrimPrefix(filepath.ToSlash(name), "/"), link, true, nil
+}
+
+// Copies exactly size bytes of path to w. Files that change size while being archived would otherwise corrupt the
+// archive since the size was already written in the entry header.
+func copyFile(w io.Writer, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(w, f, size)
+	return err
+}
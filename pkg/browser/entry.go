@@ -0,0 +1,94 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package browser
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// Caches of uid and gid to name lookups since most directories are owned by only a handful of users
+var owners = make(map[uint32]string)
+var groups = make(map[uint32]string)
+
+// Converts a single directory entry into its representation in a listing
+func NewEntry(dir string, info os.FileInfo) Entry {
+	entry := Entry {
+		Type:     TypeChar(info.Mode()),
+		Name:     info.Name(),
+		Size:     info.Size(),
+		Modified: info.ModTime().Unix(),
+		Mode:     uint32(info.Mode().Perm()),
+		Owner:    "-",
+		Group:    "-",
+	}
+
+	if info.Mode() & os.ModeSymlink != 0 {
+		if link, err := os.Readlink(filepath.Join(dir, info.Name())); err == nil {
+			entry.Target = link
+		}
+	}
+
+	// The raw mode is used to preserve the setuid, setgid and sticky bits
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.Mode = stat.Mode & 07777
+		entry.Owner = lookupOwner(stat.Uid)
+		entry.Group = lookupGroup(stat.Gid)
+	}
+
+	return entry
+}
+
+// Returns the single character used in listings to represent the type of a file
+func TypeChar(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "d"
+	case mode & os.ModeSymlink != 0:
+		return "l"
+	case mode & os.ModeCharDevice != 0:
+		return "c"
+	case mode & os.ModeDevice != 0:
+		return "b"
+	case mode & os.ModeSocket != 0:
+		return "s"
+	case mode & os.ModeNamedPipe != 0:
+		return "p"
+	case mode.IsRegular():
+		return "f"
+	}
+
+	return "?"
+}
+
+func lookupOwner(uid uint32) string {
+	if name, ok := owners[uid]; ok {
+		return name
+	}
+
+	name := strconv.FormatUint(uint64(uid), 10)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+
+	owners[uid] = name
+	return name
+}
+
+func lookupGroup(gid uint32) string {
+	if name, ok := groups[gid]; ok {
+		return name
+	}
+
+	name := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+
+	groups[gid] = name
+	return name
+}
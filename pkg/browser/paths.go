@@ -0,0 +1,86 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package browser
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Returns true if path is one of the comma separated directories in allowed or is inside one of them. Both are cleaned
+// first and only whole path components are compared, so "/tank/../etc" and "/tankfoo" are not inside "/tank".
+func IsAllowed(path string, allowed string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+
+	path = filepath.Clean(path)
+
+	for _, dir := range strings.Split(allowed, ",") {
+		dir = strings.TrimSpace(dir)
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/") + "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks that path is allowed both as it is and once symlinks are resolved, so that a link can't point outside of
+// the allowed directories. Returns the cleaned path.
+func CheckPath(path string, allowed string) (string, error) {
+	if !IsAllowed(path, allowed) {
+		return "", &Error {
+			Code:    ErrNotAllowed,
+			Message: fmt.Sprintf("path %s is not allowed", path),
+		}
+	}
+
+	path = filepath.Clean(path)
+
+	// A path that can't be resolved can't be checked, so it is rejected as well
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	} else if !IsAllowed(resolved, ResolveAll(allowed)) {
+		return "", &Error {
+			Code:    ErrNotAllowed,
+			Message: fmt.Sprintf("path %s resolves to %s, which is not allowed", path, resolved),
+		}
+	}
+
+	return path, nil
+}
+
+// Resolves symlinks in each of the comma separated paths. Paths that can't be resolved are kept as they are.
+func ResolveAll(paths string) string {
+	var resolved []string
+
+	for _, path := range strings.Split(paths, ",") {
+		if target, err := filepath.EvalSymlinks(strings.TrimSpace(path)); err == nil {
+			path = target
+		}
+
+		resolved = append(resolved, path)
+	}
+
+	return strings.Join(resolved, ",")
+}
+
+// Returns true if name matches pattern. Patterns containing glob characters are matched as a glob against the whole
+// name, all others are a case insensitive substring match.
+func MatchName(pattern string, name string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		matched, _ := filepath.Match(pattern, name)
+		return matched
+	}
+
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
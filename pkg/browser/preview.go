@@ -0,0 +1,56 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package browser
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of text formats that content sniffing can't distinguish from each other
+var textExtensions = map[string]string {
+	".json": "application/json",
+	".log":  "text/plain; charset=utf-8",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/plain; charset=utf-8",
+	".csv":  "text/plain; charset=utf-8",
+	".yml":  "text/plain; charset=utf-8",
+	".yaml": "text/plain; charset=utf-8",
+	".ini":  "text/plain; charset=utf-8",
+	".conf": "text/plain; charset=utf-8",
+}
+
+// Reads up to size bytes from the start of file and returns them along with the preview message to send before them
+func ReadPreview(file io.Reader, info os.FileInfo, size int64) (Message, []byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(file, size))
+	if err != nil {
+		return Message{}, nil, err
+	}
+
+	msg := Message {
+		Type:      TypePreview,
+		Name:      info.Name(),
+		MIME:      DetectType(info.Name(), data),
+		Truncated: info.Size() > int64(len(data)),
+	}
+
+	return msg, data, nil
+}
+
+// Detects the MIME type of a file from its contents, using the extension to refine plain text
+func DetectType(name string, data []byte) string {
+	detected := http.DetectContentType(data)
+
+	if strings.HasPrefix(detected, "text/plain") {
+		if mime, ok := textExtensions[strings.ToLower(filepath.Ext(name))]; ok {
+			return mime
+		}
+	}
+
+	return detected
+}
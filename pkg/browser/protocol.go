@@ -0,0 +1,212 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+/* Package browser contains the protocol spoken between Lifeguard and the browser helper over the helper's stdout.
+ * Every message is a frame made of a 4 byte big endian length followed by that many bytes of payload. The first frame
+ * is always a JSON encoded Message. If the message type is "file", "archive" or "preview", it is followed by any
+ * number of binary frames containing the payload and terminated by a frame with a length of zero so that truncated
+ * output (for example if the helper is killed) can be detected.
+ */
+package browser
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Incremented whenever a change is made that is incompatible with older versions of Lifeguard or the helper
+const Version = 1
+
+// Largest frame that will be accepted. This bounds the memory used by a single JSON message.
+const MaxFrameSize = 64 << 20
+
+// Message types
+const (
+	TypeListing = "listing"
+	TypeFile    = "file"
+	TypeArchive = "archive"
+	TypeSearch  = "search"
+	TypeHistory = "history"
+	TypePreview = "preview"
+	TypeError   = "error"
+)
+
+// Error codes reported by the helper
+const (
+	ErrNotAllowed       = "not-allowed"
+	ErrNotFound         = "not-found"
+	ErrPermissionDenied = "permission-denied"
+	ErrTooLarge         = "too-large"
+	ErrInvalidArgument  = "invalid-argument"
+	ErrWrongType        = "wrong-type"
+	ErrInternal         = "internal"
+)
+
+var ErrVersionMismatch = errors.New("browser protocol version mismatch")
+
+// Types are "d" (directory), "f" (regular file), "l" (symlink), "c" and "b" (character and block devices),
+// "s" (socket), "p" (FIFO) and "?" (unknown). Modified is a Unix timestamp.
+type Entry struct {
+	Type     string
+	Name     string
+	Size     int64
+	Modified int64
+	Mode     uint32
+	Owner    string
+	Group    string
+	Target   string
+}
+
+type Message struct {
+	Version   int
+	Type      string
+	Code      string  `json:",omitempty"`
+	Error     string  `json:",omitempty"`
+	Name      string  `json:",omitempty"`
+	MIME      string  `json:",omitempty"`
+	Entries   []Entry `json:",omitempty"`
+	Truncated bool    `json:",omitempty"`
+}
+
+// Returned to Lifeguard when the helper reports an error
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func WriteFrame(w io.Writer, payload []byte) error {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(payload)))
+
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+	return err
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(length)
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds maximum size", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// Writes msg as a single frame, filling in the protocol version
+func WriteMessage(w io.Writer, msg Message) error {
+	msg.Version = Version
+
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return WriteFrame(w, encoded)
+}
+
+// Reads a single message. Error messages from the helper are returned as an *Error.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var msg Message
+
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Version != Version {
+		return nil, ErrVersionMismatch
+	}
+
+	if msg.Type == TypeError {
+		return nil, &Error {
+			Code:    msg.Code,
+			Message: msg.Error,
+		}
+	}
+
+	return &msg, nil
+}
+
+// Splits everything written to it into frames. Close must be called to write the terminating frame.
+type PayloadWriter struct {
+	w io.Writer
+}
+
+func NewPayloadWriter(w io.Writer) *PayloadWriter {
+	return &PayloadWriter { w: w }
+}
+
+func (p *PayloadWriter) Write(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	if err := WriteFrame(p.w, data); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (p *PayloadWriter) Close() error {
+	return WriteFrame(p.w, nil)
+}
+
+// Reassembles a payload written by a PayloadWriter. If the stream ends before the terminating frame,
+// io.ErrUnexpectedEOF is returned.
+type PayloadReader struct {
+	r       io.Reader
+	current []byte
+	done    bool
+}
+
+func NewPayloadReader(r io.Reader) *PayloadReader {
+	return &PayloadReader { r: r }
+}
+
+func (p *PayloadReader) Read(buf []byte) (int, error) {
+	for len(p.current) == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+
+		frame, err := ReadFrame(p.r)
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+
+		p.current = frame
+		p.done = (len(frame) == 0)
+	}
+
+	n := copy(buf, p.current)
+	p.current = p.current[n:]
+
+	return n, nil
+}
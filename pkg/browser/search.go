@@ -0,0 +1,137 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package browser
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Returned from the walk function to stop searching once a limit is reached
+var errStopSearch = errors.New("search limit reached")
+
+type SearchLimits struct {
+	Depth   int
+	Results int
+	Budget  time.Duration
+}
+
+// Walks root looking for files whose name matches pattern. The names of the returned entries are relative to root.
+// The returned message is marked as truncated if any of the limits stopped the search early.
+func Search(root string, pattern string, limits SearchLimits) (Message, error) {
+	msg := Message {
+		Type:    TypeSearch,
+		Name:    root,
+		Entries: make([]Entry, 0),
+	}
+
+	deadline := time.Now().Add(limits.Budget)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if time.Now().After(deadline) {
+			msg.Truncated = true
+			return errStopSearch
+		}
+
+		// Skip anything that can't be read instead of failing the entire search
+		if err != nil {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		// Searching a dataset shouldn't also search every snapshot of it
+		if info.IsDir() && info.Name() == ".zfs" {
+			return filepath.SkipDir
+		}
+
+		if MatchName(pattern, info.Name()) {
+			entry := NewEntry(filepath.Dir(path), info)
+			entry.Name = rel
+			msg.Entries = append(msg.Entries, entry)
+
+			if len(msg.Entries) >= limits.Results {
+				msg.Truncated = true
+				return errStopSearch
+			}
+		}
+
+		if info.IsDir() && strings.Count(rel, string(filepath.Separator)) + 1 >= limits.Depth {
+			msg.Truncated = true
+			return filepath.SkipDir
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errStopSearch {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+// Looks for rel in every snapshot of the dataset mounted at root. The names of the returned entries are the names
+// of the snapshots that contain it. Since rel can contain directories that are symlinks in some snapshots, the
+// directory containing it is resolved in each snapshot and must still be within allowed (which should already have
+// its own symlinks resolved).
+func History(root string, rel string, allowed string) (Message, error) {
+	rel = filepath.Clean("/" + rel)[1:]
+	if rel == "" {
+		return Message{}, &Error {
+			Code:    ErrInvalidArgument,
+			Message: "path to search for must not be empty",
+		}
+	}
+
+	snapshots, err := ioutil.ReadDir(filepath.Join(root, ".zfs", "snapshot"))
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message {
+		Type:    TypeHistory,
+		Name:    rel,
+		Entries: make([]Entry, 0),
+	}
+
+	for _, snapshot := range snapshots {
+		path := filepath.Join(root, ".zfs", "snapshot", snapshot.Name(), rel)
+
+		dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+		if err != nil {
+			continue
+		} else if !IsAllowed(dir, allowed) {
+			log.Printf("Skipping %s since it resolves to %s, which is not allowed", path, dir)
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			continue
+		}
+
+		entry := NewEntry(dir, info)
+		entry.Name = snapshot.Name()
+		msg.Entries = append(msg.Entries, entry)
+	}
+
+	return msg, nil
+}
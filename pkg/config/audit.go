@@ -0,0 +1,108 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func AddAuditEntry(entry structs.AuditEntry) error {
+	params, err := json.Marshal(entry.Parameters)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit parameters: %w", err)
+	}
+
+	stmt := prepare("insert into audit (Time, Username, IP, Action, Target, Parameters, Result, Stderr) values (?, ?, ?, ?, ?, ?, ?, ?)")
+	defer stmt.Close()
+
+	_, err = stmt.Exec(entry.Time, entry.Username, entry.IP, entry.Action, entry.Target, string(params), entry.Result,
+		entry.Stderr)
+	if err != nil {
+		return fmt.Errorf("unable to save audit entry: %w", err)
+	}
+
+	return nil
+}
+
+// Returns matching audit entries, newest first. Target matches any entry whose target contains it.
+func GetAuditEntries(filter structs.AuditFilter) ([]structs.AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, arg interface{}) {
+		conditions = append(conditions, condition)
+		args = append(args, arg)
+	}
+
+	if filter.Username != "" {
+		add("Username = ?", filter.Username)
+	}
+
+	if filter.Action != "" {
+		add("Action = ?", filter.Action)
+	}
+
+	if filter.Target != "" {
+		add("instr(Target, ?) > 0", filter.Target)
+	}
+
+	if filter.Result != "" {
+		add("Result = ?", filter.Result)
+	}
+
+	if filter.Since != 0 {
+		add("Time >= ?", filter.Since)
+	}
+
+	if filter.Until != 0 {
+		add("Time <= ?", filter.Until)
+	}
+
+	query := "select ID, Time, Username, IP, Action, Target, Parameters, Result, Stderr from audit"
+	if len(conditions) != 0 {
+		query += " where " + strings.Join(conditions, " and ")
+	}
+	query += " order by ID desc"
+
+	if filter.Limit > 0 {
+		query += " limit ?"
+		args = append(args, filter.Limit)
+	}
+
+	stmt := prepare(query)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]structs.AuditEntry, 0)
+	for rows.Next() {
+		var entry structs.AuditEntry
+		var params string
+
+		err := rows.Scan(&entry.ID, &entry.Time, &entry.Username, &entry.IP, &entry.Action, &entry.Target, &params,
+			&entry.Result, &entry.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read audit entry: %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(params), &entry.Parameters); err != nil {
+			log.Printf("Unable to decode parameters of audit entry %d: %s", entry.ID, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
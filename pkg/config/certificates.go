@@ -0,0 +1,77 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Maps a client certificate subject to a user, replacing any existing mapping for the subject
+func SetClientCertificate(subject string, username string) error {
+	stmt := prepare("insert or replace into certificates values (?, ?)")
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(subject, username); err != nil {
+		return fmt.Errorf("unable to save client certificate for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Returns the user that a client certificate subject is mapped to
+func GetClientCertificateUser(subject string) (string, bool) {
+	var username string
+
+	stmt := prepare("select Username from certificates where Subject = ?")
+	defer stmt.Close()
+
+	if err := stmt.QueryRow(subject).Scan(&username); err != nil {
+		return "", false
+	}
+
+	return username, true
+}
+
+func GetClientCertificates() ([]structs.ClientCertificate, error) {
+	certs := make([]structs.ClientCertificate, 0)
+
+	stmt := prepare("select Subject, Username from certificates order by Username, Subject")
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get client certificates: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cert structs.ClientCertificate
+
+		if err := rows.Scan(&cert.Subject, &cert.Username); err != nil {
+			return nil, fmt.Errorf("unable to read client certificate: %w", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, rows.Err()
+}
+
+// Removes the mapping for subject and returns true if it existed
+func DeleteClientCertificate(subject string) (bool, error) {
+	stmt := prepare("delete from certificates where Subject = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(subject)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete client certificate %s: %w", subject, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
@@ -4,12 +4,15 @@
 package config
 
 import (
-	"log"
 	"database/sql"
+	"fmt"
+	"log"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// Statements only fail to prepare if they are invalid or the database can't be opened at all, so this exits instead of
+// returning an error. Errors from running a statement must be returned.
 func prepare(raw string) *sql.Stmt {
 	stmt, err := db.Prepare(raw)
 	if err != nil {
@@ -19,26 +22,70 @@ func prepare(raw string) *sql.Stmt {
 	return stmt
 }
 
-func GetTwoFactorProvider(username string) string {
+func GetTwoFactorProvider(username string) (string, error) {
 	var provider string
 
 	stmt := prepare("select TwoFactorProvider from auth where Username = ?")
 	defer stmt.Close()
 
-	if err := stmt.QueryRow(username).Scan(&provider); err != nil {
-		log.Fatalf("Unable to get TOTP provider for user %s: %s", username, err)
+	err := stmt.QueryRow(username).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%w %s", ErrUnknownUser, username)
+	} else if err != nil {
+		return "", fmt.Errorf("unable to get two factor provider for %s: %w", username, err)
 	}
 
-	return provider
+	return provider, nil
 }
 
-func IsTwoFactorEnabled(username string) bool {
-	return GetTwoFactorProvider(username) != ""
+// Returns every second factor the user has set up. WebAuthn is listed first since it is preferred over TOTP.
+func GetTwoFactorProviders(username string) ([]string, error) {
+	providers := make([]string, 0)
+
+	webauthn, err := HasWebAuthn(username)
+	if err != nil {
+		return nil, err
+	} else if webauthn {
+		providers = append(providers, "webauthn")
+	}
+
+	provider, err := GetTwoFactorProvider(username)
+	if err != nil {
+		return nil, err
+	} else if provider != "" {
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
 }
 
-func DisableTwoFactor(username string) {
-	stmt := prepare("update auth set TwoFactorProvider = '', TwoFactorData = '' where Username = ?")
-	defer stmt.Close()
-	
-	stmt.Exec(username)	
+func IsTwoFactorEnabled(username string) (bool, error) {
+	providers, err := GetTwoFactorProviders(username)
+	return len(providers) != 0, err
+}
+
+func DisableTwoFactor(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
+
+	if _, err := tx.Exec("update auth set TwoFactorProvider = '', TwoFactorData = '' where Username = ?", username); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to disable two factor for %s: %w", username, err)
+	}
+
+	// Table names can't be placeholders but they are constants
+	for _, table := range []string { "webauthn", "recovery" } {
+		if _, err := tx.Exec("delete from " + table + " where Username = ?", username); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to delete %s for %s: %w", table, username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to disable two factor for %s: %w", username, err)
+	}
+
+	return nil
 }
@@ -7,10 +7,13 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"strconv"
 	"os"
 	"log"
 
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
 )
@@ -20,15 +23,7 @@ var driver = "sqlite3"
 var connString = "./config/config.db"
 
 func Load() {
-	err := errors.New("OK")
-
-	db, err = sql.Open(driver, connString)
-	if errors.Is(err, errors.New("OK")) {
-		log.Fatalf("Unable to connect to database: %s", err)
-	}
-
-	prepare("create table if not exists config (Key string primary key unique, Value string not null)").Exec()
-	prepare("create table if not exists auth (Username string primary key unique, Password string not null, TwoFactorProvider string, TwoFactorData string)").Exec()
+	LoadDatabase(connString)
 
 	if loadLegacy() {
 		path := viper.ConfigFileUsed()
@@ -44,6 +39,42 @@ func Load() {
 	}
 }
 
+// Opens the database at path and creates or migrates its tables. Load should be used instead outside of tests.
+func LoadDatabase(path string) {
+	err := errors.New("OK")
+
+	db, err = sql.Open(driver, path)
+	if errors.Is(err, errors.New("OK")) {
+		log.Fatalf("Unable to connect to database: %s", err)
+	}
+
+	prepare("create table if not exists config (Key string primary key unique, Value string not null)").Exec()
+	prepare("create table if not exists auth (Username string primary key unique, Password string not null, TwoFactorProvider string, TwoFactorData string)").Exec()
+	prepare("create table if not exists scopes (Username string not null, Object string not null, primary key (Username, Object))").Exec()
+	prepare("create table if not exists tokens (ID string primary key unique, Username string not null, Name string not null, Hash string not null, Scopes string not null, Created integer not null, Expires integer not null, LastUsed integer not null)").Exec()
+	prepare("create table if not exists webauthn (ID string primary key unique, Username string not null, Name string not null, PublicKey blob not null, SignCount integer not null, Created integer not null, LastUsed integer not null)").Exec()
+	prepare("create table if not exists recovery (Username string not null, Hash string not null, primary key (Username, Hash))").Exec()
+	prepare("create table if not exists sessions (ID string primary key unique, Username string not null, Data blob not null, IP string not null, UserAgent string not null, Created integer not null, LastSeen integer not null)").Exec()
+	prepare("create table if not exists certificates (Subject string primary key unique, Username string not null)").Exec()
+	prepare("create table if not exists socket_users (UID integer primary key unique, Username string not null)").Exec()
+	prepare("create table if not exists audit (ID integer primary key autoincrement, Time integer not null, Username string not null, IP string not null, Action string not null, Target string not null, Parameters string not null, Result string not null, Stderr string not null)").Exec()
+
+	migrate()
+}
+
+// Returns an error if the database can't be queried
+func Ping() error {
+	var count int
+	return db.QueryRow("select count(*) from config").Scan(&count)
+}
+
+// Closes the database. Nothing else in this package can be used afterwards.
+func Close() {
+	if err := db.Close(); err != nil {
+		log.Printf("Unable to close database: %s", err)
+	}
+}
+
 func loadLegacy() bool {
 	viper.SetConfigName("config")
 
@@ -87,7 +118,9 @@ func migrateFromLegacy() {
 	migrateConfig("debug.parse", tx)
 	
 	// Stage 2: Migrate the admin account
-	CreateUser("admin", viper.GetString("security.admin"), tx)
+	if err := CreateUser("admin", viper.GetString("security.admin"), structs.RoleAdmin, tx); err != nil {
+		log.Fatalf("Migration failed: %s", err)
+	}
 
 	if err = tx.Commit(); err != nil {
 		log.Fatalf("Migration failed: unable to commit migration transaction: %s", err)
@@ -114,7 +147,7 @@ func migrateConfig(key string, tx *sql.Tx) {
 	
 	stmt := tx.Stmt(prepare("insert into config values (?, ?)"))
 	if _, err := stmt.Exec(key, value); err != nil {
-		log.Fatalf("Migration failed for key %s: insert failed: %s", err)
+		log.Fatalf("Migration failed for key %s: insert failed: %s", key, err)
 	}
 	
 	stmt.Close()
@@ -125,33 +158,49 @@ func GetBool(key string, def bool) bool {
 	return raw == "true"
 }
 
+// Returns the value of key. Missing keys are saved with the default value so that they can be found and changed.
+// If the database can't be read, the default is returned.
 func GetString(key string, def string) string {
 	var value string
 
 	stmt := prepare("select Value from config where Key = ?")
 	defer stmt.Close()
 
-	row := stmt.QueryRow(key)
-	if err := row.Scan(&value); err != nil {
-		Set(key, def)
-		return GetString(key, def)
+	err := stmt.QueryRow(key).Scan(&value)
+	if err == sql.ErrNoRows {
+		if err := Set(key, def); err != nil {
+			log.Printf("Unable to save default value for %s: %s", key, err)
+		}
+
+		return def
+
+	} else if err != nil {
+		log.Printf("Unable to get value for %s, using default: %s", key, err)
+		return def
 	}
 
 	return value
 }
 
-func Set(key string, value interface{}) {
-	stmt := prepare("delete from config where Key = ?")
-	defer stmt.Close()
+func Set(key string, value interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
 
-	if _, err := stmt.Exec(key); err != nil {
-		log.Fatalf("Unable to set value for %s: %s", key, err)
+	if _, err := tx.Exec("delete from config where Key = ?", key); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to set value for %s: %w", key, err)
 	}
 
-	insert := prepare("insert into config values (?, ?)")
-	defer insert.Close()
+	if _, err := tx.Exec("insert into config values (?, ?)", key, value); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to set value for %s: %w", key, err)
+	}
 
-	if ret, insErr := insert.Exec(key, value); insErr != nil {
-		log.Fatalf("Unable to set value for %s: error '%s', ret '%s'", key, insErr, ret)
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to set value for %s: %w", key, err)
 	}
+
+	return nil
 }
@@ -0,0 +1,52 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"log"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Schema changes to tables that already exist. Each statement is run exactly once, in order, and the number that have
+// been applied is saved in SQLite's user_version pragma. New statements must only ever be appended to this list.
+var migrations = []string {
+	// 1: Roles. Existing users keep the unrestricted access they had before roles were introduced.
+	"alter table auth add column Role string not null default 'admin'",
+
+	// 2: Last TOTP time step used by each user so codes can't be replayed
+	"alter table auth add column TOTPCounter integer not null default 0",
+}
+
+func migrate() {
+	var version int
+
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		log.Fatalf("Unable to get schema version: %s", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Printf("Migrating database to schema version %d", version + 1)
+
+		// The migration and the new version are committed together so a failed migration is retried on the next start
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatalf("Unable to create migration transaction: %s", err)
+		}
+
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			log.Fatalf("Unable to migrate database to schema version %d: %s", version + 1, err)
+		}
+
+		// Pragmas can't be set with placeholders but version is always an integer
+		if _, err := tx.Exec("pragma user_version = " + strconv.Itoa(version + 1)); err != nil {
+			log.Fatalf("Unable to set schema version %d: %s", version + 1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			log.Fatalf("Unable to commit migration to schema version %d: %s", version + 1, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Replaces all of the user's recovery codes. Only the hashes of the codes are stored.
+func SetRecoveryCodes(username string, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
+
+	if _, err := tx.Exec("delete from recovery where Username = ?", username); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to clear recovery codes for %s: %w", username, err)
+	}
+
+	for _, hash := range hashes {
+		if _, err := tx.Exec("insert into recovery values (?, ?)", username, hash); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to add recovery code for %s: %w", username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to save recovery codes for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Deletes the recovery code with the given hash and returns true if it existed. Since the code is deleted in the same
+// statement that checks for it, each code can only ever be used once.
+func UseRecoveryCode(username string, hash string) (bool, error) {
+	stmt := prepare("delete from recovery where Username = ? and Hash = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(username, hash)
+	if err != nil {
+		return false, fmt.Errorf("unable to use recovery code for %s: %w", username, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
+
+func CountRecoveryCodes(username string) (int, error) {
+	var count int
+
+	stmt := prepare("select count(*) from recovery where Username = ?")
+	defer stmt.Close()
+
+	if err := stmt.QueryRow(username).Scan(&count); err != nil {
+		return 0, fmt.Errorf("unable to count recovery codes for %s: %w", username, err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Returns the pools and datasets that the user is limited to. Users without any scopes can access everything.
+func GetScopes(username string) ([]string, error) {
+	var scopes []string
+
+	stmt := prepare("select Object from scopes where Username = ? order by Object")
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list scopes for %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var object string
+
+		if err := rows.Scan(&object); err != nil {
+			return nil, fmt.Errorf("unable to list scope for %s: %w", username, err)
+		}
+
+		scopes = append(scopes, object)
+	}
+
+	// An error part way through must not be mistaken for a shorter (or empty, and so unrestricted) list
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list scopes for %s: %w", username, err)
+	}
+
+	return scopes, nil
+}
+
+// Replaces all scopes for the user. Passing an empty list removes all restrictions.
+func SetScopes(username string, scopes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
+
+	if _, err := tx.Exec("delete from scopes where Username = ?", username); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to clear scopes for %s: %w", username, err)
+	}
+
+	for _, scope := range scopes {
+		if _, err := tx.Exec("insert or ignore into scopes values (?, ?)", username, scope); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to add scope %s for %s: %w", scope, username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to save scopes for %s: %w", username, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sessionColumns = "ID, Username, Data, IP, UserAgent, Created, LastSeen"
+
+// Creates the session or replaces its data and owner if it already exists
+func SaveSession(session structs.Session) error {
+	stmt := prepare("insert or replace into sessions (" + sessionColumns + ") values (?, ?, ?, ?, ?, ?, ?)")
+	defer stmt.Close()
+
+	_, err := stmt.Exec(session.ID, session.Username, session.Data, session.IP, session.UserAgent, session.Created,
+		session.LastSeen)
+	if err != nil {
+		return fmt.Errorf("unable to save session for %s: %w", session.Username, err)
+	}
+
+	return nil
+}
+
+func GetSession(id string) (structs.Session, bool) {
+	var session structs.Session
+
+	stmt := prepare("select " + sessionColumns + " from sessions where ID = ?")
+	defer stmt.Close()
+
+	err := stmt.QueryRow(id).Scan(&session.ID, &session.Username, &session.Data, &session.IP, &session.UserAgent,
+		&session.Created, &session.LastSeen)
+
+	return session, err == nil
+}
+
+// Returns all sessions belonging to username, most recently used first
+func GetSessions(username string) ([]structs.Session, error) {
+	list := make([]structs.Session, 0)
+
+	stmt := prepare("select " + sessionColumns + " from sessions where Username = ? order by LastSeen desc")
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list sessions for %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session structs.Session
+
+		err := rows.Scan(&session.ID, &session.Username, &session.Data, &session.IP, &session.UserAgent,
+			&session.Created, &session.LastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list session for %s: %w", username, err)
+		}
+
+		list = append(list, session)
+	}
+
+	return list, rows.Err()
+}
+
+func TouchSession(id string, lastSeen int64) {
+	stmt := prepare("update sessions set LastSeen = ? where ID = ?")
+	defer stmt.Close()
+
+	stmt.Exec(lastSeen, id)
+}
+
+func DeleteSession(id string) {
+	stmt := prepare("delete from sessions where ID = ?")
+	defer stmt.Close()
+
+	stmt.Exec(id)
+}
+
+// Deletes the session and returns true if it existed and belonged to username
+func RevokeSession(username string, id string) (bool, error) {
+	stmt := prepare("delete from sessions where Username = ? and ID = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(username, id)
+	if err != nil {
+		return false, fmt.Errorf("unable to revoke session for %s: %w", username, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
+
+// Deletes every session belonging to username except the one with ID except (which may be empty)
+func RevokeSessions(username string, except string) error {
+	stmt := prepare("delete from sessions where Username = ? and ID != ?")
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(username, except); err != nil {
+		return fmt.Errorf("unable to revoke sessions for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Deletes sessions that were last used before idle or created before created
+func PruneSessions(idle int64, created int64) {
+	stmt := prepare("delete from sessions where LastSeen < ? or Created < ?")
+	defer stmt.Close()
+
+	stmt.Exec(idle, created)
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Maps a local user ID to a user, replacing any existing mapping for the ID
+func SetSocketUser(uid uint32, username string) error {
+	stmt := prepare("insert or replace into socket_users values (?, ?)")
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(uid, username); err != nil {
+		return fmt.Errorf("unable to save socket user for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Returns the user that a local user ID is mapped to
+func GetSocketUser(uid uint32) (string, bool) {
+	var username string
+
+	stmt := prepare("select Username from socket_users where UID = ?")
+	defer stmt.Close()
+
+	if err := stmt.QueryRow(uid).Scan(&username); err != nil {
+		return "", false
+	}
+
+	return username, true
+}
+
+func GetSocketUsers() ([]structs.SocketUser, error) {
+	users := make([]structs.SocketUser, 0)
+
+	stmt := prepare("select UID, Username from socket_users order by UID")
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get socket users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user structs.SocketUser
+
+		if err := rows.Scan(&user.UID, &user.Username); err != nil {
+			return nil, fmt.Errorf("unable to read socket user: %w", err)
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// Removes the mapping for uid and returns true if it existed
+func DeleteSocketUser(uid uint32) (bool, error) {
+	stmt := prepare("delete from socket_users where UID = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(uid)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete socket user %d: %w", uid, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Saves a new token. Only the hash of the token's secret is stored.
+func SaveToken(token structs.Token, hash string) error {
+	stmt := prepare("insert into tokens values (?, ?, ?, ?, ?, ?, ?, ?)")
+	defer stmt.Close()
+
+	_, err := stmt.Exec(token.ID, token.Username, token.Name, hash, strings.Join(token.Scopes, ","), token.Created,
+		token.Expires, token.LastUsed)
+	if err != nil {
+		return fmt.Errorf("unable to save token for %s: %w", token.Username, err)
+	}
+
+	return nil
+}
+
+// Returns the token with the given ID along with the hash of its secret
+func GetToken(id string) (structs.Token, string, bool) {
+	var token structs.Token
+	var hash string
+	var scopes string
+
+	stmt := prepare("select ID, Username, Name, Hash, Scopes, Created, Expires, LastUsed from tokens where ID = ?")
+	defer stmt.Close()
+
+	err := stmt.QueryRow(id).Scan(&token.ID, &token.Username, &token.Name, &hash, &scopes, &token.Created,
+		&token.Expires, &token.LastUsed)
+	if err != nil {
+		return token, "", false
+	}
+
+	token.Scopes = splitList(scopes)
+	return token, hash, true
+}
+
+func SetTokenLastUsed(id string, when int64) {
+	stmt := prepare("update tokens set LastUsed = ? where ID = ?")
+	defer stmt.Close()
+
+	stmt.Exec(when, id)
+}
+
+func GetTokens(username string) ([]structs.Token, error) {
+	tokens := make([]structs.Token, 0)
+
+	stmt := prepare("select ID, Username, Name, Scopes, Created, Expires, LastUsed from tokens where Username = ? order by Created")
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list tokens for %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token structs.Token
+		var scopes string
+
+		err := rows.Scan(&token.ID, &token.Username, &token.Name, &scopes, &token.Created, &token.Expires, &token.LastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list token for %s: %w", username, err)
+		}
+
+		token.Scopes = splitList(scopes)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// Deletes the token and returns true if it existed and belonged to username
+func RevokeToken(username string, id string) (bool, error) {
+	stmt := prepare("delete from tokens where Username = ? and ID = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(username, id)
+	if err != nil {
+		return false, fmt.Errorf("unable to revoke token %s: %w", id, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
+
+// Splits a comma separated list, returning an empty slice (rather than a slice with one empty string) for ""
+func splitList(raw string) []string {
+	if raw == "" {
+		return []string { }
+	}
+
+	return strings.Split(raw, ",")
+}
@@ -5,14 +5,25 @@ package config
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/base64"
+	"fmt"
 	"image/png"
 	"log"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
 	"github.com/pquerna/otp/totp"
 )
 
+// Length of a TOTP time step in seconds and the number of steps before and after the current one that are accepted
+const (
+	totpPeriod = 30
+	totpSkew   = 1
+)
+
 func InitializeTOTP(username string) (string, string) {
 	secret, _ := totp.Generate(totp.GenerateOpts {
 		Issuer: "Lifeguard",
@@ -31,20 +42,49 @@ func InitializeTOTP(username string) (string, string) {
 	return secret.Secret(), base64.StdEncoding.EncodeToString(buf.Bytes())
 }
 
-func SaveTOTP(username string, secret string, code string) bool {
-	if !totp.Validate(code, secret) {
-		return false
+// Returns the time step that code is valid for. Unlike totp.Validate, this allows a code to be rejected if it (or a
+// code from an earlier time step) was already used.
+func matchTOTP(secret string, code string) (uint64, bool) {
+	// Users without TOTP have an empty secret, which still generates valid codes
+	if secret == "" {
+		return 0, false
+	}
+
+	current := uint64(time.Now().Unix()) / totpPeriod
+
+	for counter := current - totpSkew; counter <= current + totpSkew; counter++ {
+		expected, err := hotp.GenerateCodeCustom(secret, counter, hotp.ValidateOpts {
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// Saves secret as the user's TOTP secret if code is valid for it. Returns false if the code is invalid.
+func SaveTOTP(username string, secret string, code string) (bool, error) {
+	counter, ok := matchTOTP(secret, code)
+	if !ok {
+		return false, nil
 	}
 
-	stmt := prepare("update auth set TwoFactorProvider = 'totp', TwoFactorData = ? where Username = ?")
+	// The code used to set up TOTP also can't be used to log in
+	stmt := prepare("update auth set TwoFactorProvider = 'totp', TwoFactorData = ?, TOTPCounter = ? where Username = ?")
 	defer stmt.Close()
-	
-	stmt.Exec(secret, username)
 
-	return true
+	if _, err := stmt.Exec(secret, counter, username); err != nil {
+		return false, fmt.Errorf("unable to save TOTP secret for %s: %w", username, err)
+	}
+
+	return true, nil
 }
 
-func VerifyTOTP(username string, code string) bool {
+func VerifyTOTP(username string, code string) (bool, error) {
 	var secret string
 
 	stmt := prepare("select TwoFactorData from auth where Username = ?")
@@ -52,14 +92,29 @@ func VerifyTOTP(username string, code string) bool {
 
 	err := stmt.QueryRow(username).Scan(&secret)
 	if err != nil {
-		log.Fatalf("Unable to get TOTP secret for user %s: %s", username, err)
+		return false, fmt.Errorf("unable to get TOTP secret for %s: %w", username, err)
 	}
 
-	if !totp.Validate(code, secret) {
+	counter, ok := matchTOTP(secret, code)
+	if !ok {
 		log.Printf("%s failed 2FA challenge: Invalid TOTP code", username)
-		return false
+		return false, nil
+	}
+
+	// Checking and updating the counter in one statement prevents two concurrent logins from using the same code
+	update := prepare("update auth set TOTPCounter = ? where Username = ? and TOTPCounter < ?")
+	defer update.Close()
+
+	res, err := update.Exec(counter, username, counter)
+	if err != nil {
+		return false, fmt.Errorf("unable to save TOTP counter for %s: %w", username, err)
+	}
+
+	if count, _ := res.RowsAffected(); count == 0 {
+		log.Printf("%s failed 2FA challenge: TOTP code was already used", username)
+		return false, nil
 	}
 
 	log.Printf("%s authenticated successfully", username)
-	return true
+	return true, nil
 }
\ No newline at end of file
@@ -5,7 +5,8 @@ package config
 
 import (
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
 
 	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
 
@@ -24,17 +25,24 @@ func IsUser(username string) bool {
 	return count != 0
 }
 
-func GetUser(raw string) structs.User {
+// Returned (wrapped) by GetUser when there is no user with the requested name
+var ErrUnknownUser = errors.New("unknown user")
+
+func GetUser(raw string) (structs.User, error) {
 	var username string
 	var password string
 	var tfaProvider string
 	var tfaData string
+	var role string
 
-	stmt := prepare("select * from auth where Username = ?")
+	stmt := prepare("select Username, Password, TwoFactorProvider, TwoFactorData, Role from auth where Username = ?")
 	defer stmt.Close()
 
-	if err := stmt.QueryRow(raw).Scan(&username, &password, &tfaProvider, &tfaData); err != nil {
-		log.Fatalf("Unable to get user with name %s: %s", raw, err)
+	err := stmt.QueryRow(raw).Scan(&username, &password, &tfaProvider, &tfaData, &role)
+	if err == sql.ErrNoRows {
+		return structs.User { }, fmt.Errorf("%w %s", ErrUnknownUser, raw)
+	} else if err != nil {
+		return structs.User { }, fmt.Errorf("unable to get user %s: %w", raw, err)
 	}
 
 	return structs.User {
@@ -42,18 +50,19 @@ func GetUser(raw string) structs.User {
 		Password:          password,
 		TwoFactorProvider: tfaProvider,
 		TwoFactorData:     tfaData,
-	}
+		Role:              role,
+	}, nil
 }
 
-func GetUsers() map[string]structs.User {
+func GetUsers() (map[string]structs.User, error) {
 	var users = make(map[string]structs.User)
 
-	stmt := prepare("select * from auth")
+	stmt := prepare("select Username, Password, TwoFactorProvider, TwoFactorData, Role from auth")
 	defer stmt.Close()
 
 	rows, err := stmt.Query()
 	if err != nil {
-		log.Fatalf("Unable to list users: %s", err)
+		return nil, fmt.Errorf("unable to list users: %w", err)
 	}
 	defer rows.Close()
 
@@ -62,9 +71,10 @@ func GetUsers() map[string]structs.User {
 		var password string
 		var tfaProvider string
 		var tfaData string
+		var role string
 
-		if err := rows.Scan(&username, &password, &tfaProvider, &tfaData); err != nil {
-			log.Fatalf("Unable to list user: %s", err)
+		if err := rows.Scan(&username, &password, &tfaProvider, &tfaData, &role); err != nil {
+			return nil, fmt.Errorf("unable to list user: %w", err)
 		}
 
 		users[username] = structs.User {
@@ -72,26 +82,126 @@ func GetUsers() map[string]structs.User {
 			Password:          password,
 			TwoFactorProvider: tfaProvider,
 			TwoFactorData:     tfaData,
+			Role:              role,
 		}
 	}
 
-	return users
+	return users, rows.Err()
 }
 
 // TODO: remove tx param after migration done
-func CreateUser(username string, hash string, tx *sql.Tx) {
-	stmt := prepare("insert into auth values (?, ?, '', '')")
+func CreateUser(username string, hash string, role string, tx *sql.Tx) error {
+	stmt := prepare("insert into auth (Username, Password, TwoFactorProvider, TwoFactorData, Role) values (?, ?, '', '', ?)")
 	if tx != nil {
 		stmt = tx.Stmt(stmt)
 	}
 	defer stmt.Close()
 
-	stmt.Exec(username, hash)
+	if _, err := stmt.Exec(username, hash, role); err != nil {
+		return fmt.Errorf("unable to create user %s: %w", username, err)
+	}
+
+	return nil
 }
 
-func SetPassword(username string, hash string) {
+func SetPassword(username string, hash string) error {
 	stmt := prepare("update auth set Password = ? where Username = ?")
 	defer stmt.Close()
-	
-	stmt.Exec(hash, username)
+
+	if _, err := stmt.Exec(hash, username); err != nil {
+		return fmt.Errorf("unable to set password for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Returns the role of the user or an empty string (which has no permissions) if the user doesn't exist
+func GetRole(username string) string {
+	var role string
+
+	stmt := prepare("select Role from auth where Username = ?")
+	defer stmt.Close()
+
+	stmt.QueryRow(username).Scan(&role)
+
+	return role
+}
+
+// Returned (wrapped) by SetRole and DeleteUser when the change would leave nobody with the admin role
+var ErrLastAdmin = errors.New("at least one administrator must remain")
+
+// Returns ErrLastAdmin if username is the only user with the admin role. This runs inside the transaction making the
+// change so that two administrators can't remove each other at the same time.
+func checkAdminRemains(tx *sql.Tx, username string) error {
+	var role string
+	var others int
+
+	err := tx.QueryRow("select Role from auth where Username = ?", username).Scan(&role)
+	if err == sql.ErrNoRows || (err == nil && role != structs.RoleAdmin) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("unable to get role for %s: %w", username, err)
+	}
+
+	err = tx.QueryRow("select count(*) from auth where Role = ? and Username != ?", structs.RoleAdmin, username).Scan(&others)
+	if err != nil {
+		return fmt.Errorf("unable to count administrators: %w", err)
+	} else if others == 0 {
+		return fmt.Errorf("%w: %s is the only administrator", ErrLastAdmin, username)
+	}
+
+	return nil
+}
+
+// Changes the role of username. The last administrator can't be given another role.
+func SetRole(username string, role string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
+
+	if role != structs.RoleAdmin {
+		if err := checkAdminRemains(tx, username); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("update auth set Role = ? where Username = ?", role, username); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unable to set role for %s: %w", username, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to set role for %s: %w", username, err)
+	}
+
+	return nil
+}
+
+// Deletes the user along with everything that belongs to them. The last administrator can't be deleted.
+func DeleteUser(username string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to create transaction: %w", err)
+	}
+
+	if err := checkAdminRemains(tx, username); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, table := range []string { "scopes", "tokens", "webauthn", "recovery", "sessions", "certificates", "socket_users", "auth" } {
+		// Table names can't be placeholders but they are constants
+		if _, err := tx.Exec("delete from " + table + " where Username = ?", username); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to delete %s for user %s: %w", table, username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("unable to delete user %s: %w", username, err)
+	}
+
+	return nil
 }
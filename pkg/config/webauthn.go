@@ -0,0 +1,116 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func SaveWebAuthnCredential(cred structs.WebAuthnCredential) error {
+	stmt := prepare("insert into webauthn values (?, ?, ?, ?, ?, ?, ?)")
+	defer stmt.Close()
+
+	_, err := stmt.Exec(cred.ID, cred.Username, cred.Name, cred.PublicKey, cred.SignCount, cred.Created, cred.LastUsed)
+	if err != nil {
+		return fmt.Errorf("unable to save WebAuthn credential for %s: %w", cred.Username, err)
+	}
+
+	return nil
+}
+
+// Returns all authenticators registered by username, oldest first
+func GetWebAuthnCredentials(username string) ([]structs.WebAuthnCredential, error) {
+	creds := make([]structs.WebAuthnCredential, 0)
+
+	stmt := prepare("select ID, Username, Name, PublicKey, SignCount, Created, LastUsed from webauthn where Username = ? order by Created")
+	defer stmt.Close()
+
+	rows, err := stmt.Query(username)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list WebAuthn credentials for %s: %w", username, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cred structs.WebAuthnCredential
+
+		err := rows.Scan(&cred.ID, &cred.Username, &cred.Name, &cred.PublicKey, &cred.SignCount, &cred.Created, &cred.LastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list WebAuthn credential for %s: %w", username, err)
+		}
+
+		creds = append(creds, cred)
+	}
+
+	return creds, rows.Err()
+}
+
+// Returns the credential with the given ID if it belongs to username
+func GetWebAuthnCredential(username string, id string) (structs.WebAuthnCredential, bool) {
+	var cred structs.WebAuthnCredential
+
+	stmt := prepare("select ID, Username, Name, PublicKey, SignCount, Created, LastUsed from webauthn where Username = ? and ID = ?")
+	defer stmt.Close()
+
+	err := stmt.QueryRow(username, id).Scan(&cred.ID, &cred.Username, &cred.Name, &cred.PublicKey, &cred.SignCount,
+		&cred.Created, &cred.LastUsed)
+
+	return cred, err == nil
+}
+
+func IsWebAuthnCredential(id string) (bool, error) {
+	var count int
+
+	stmt := prepare("select count(*) from webauthn where ID = ?")
+	defer stmt.Close()
+
+	if err := stmt.QueryRow(id).Scan(&count); err != nil {
+		return false, fmt.Errorf("unable to check for WebAuthn credential %s: %w", id, err)
+	}
+
+	return count != 0, nil
+}
+
+// Saves the signature counter returned by the authenticator after a successful assertion
+func UpdateWebAuthnCredential(id string, signCount uint32, lastUsed int64) error {
+	stmt := prepare("update webauthn set SignCount = ?, LastUsed = ? where ID = ?")
+	defer stmt.Close()
+
+	if _, err := stmt.Exec(signCount, lastUsed, id); err != nil {
+		return fmt.Errorf("unable to update WebAuthn credential %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// Deletes the credential and returns true if it existed and belonged to username
+func DeleteWebAuthnCredential(username string, id string) (bool, error) {
+	stmt := prepare("delete from webauthn where Username = ? and ID = ?")
+	defer stmt.Close()
+
+	res, err := stmt.Exec(username, id)
+	if err != nil {
+		return false, fmt.Errorf("unable to delete WebAuthn credential %s: %w", id, err)
+	}
+
+	count, _ := res.RowsAffected()
+	return count != 0, nil
+}
+
+func HasWebAuthn(username string) (bool, error) {
+	var count int
+
+	stmt := prepare("select count(*) from webauthn where Username = ?")
+	defer stmt.Close()
+
+	if err := stmt.QueryRow(username).Scan(&count); err != nil {
+		return false, fmt.Errorf("unable to count WebAuthn credentials for %s: %w", username, err)
+	}
+
+	return count != 0, nil
+}
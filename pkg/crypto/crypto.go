@@ -54,6 +54,18 @@ func HashPassword(plaintext string) string {
 	return string(hash)
 }
 
+// Hashes a high entropy secret (such as an API token) for storage. Unlike passwords, these secrets are long enough
+// that a slow hash isn't needed.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compares two hashes from HashToken in constant time
+func TokensEqual(a string, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
 func GetRandom(n int) string {
 	b := generateRandomBytes(n)
 	return hex.EncodeToString(b)
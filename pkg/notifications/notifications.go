@@ -10,21 +10,45 @@ import (
 	"log"
 	"log/syslog"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
 )
 
-// Make a slice with length 0 so it encodes as [] and not null
-var Notifications = make([]structs.Notification, 0)
+// Notifications are sent from the pool poller and from login handlers at the same time, so the list and the syslog
+// connection are guarded by lock
+var lock sync.Mutex
+var sent []structs.Notification
 var syslogger *log.Logger
+var syslogWriter *syslog.Writer
 
 func Initialize() {
-	temp, err := syslog.NewLogger(syslog.LOG_WARNING | syslog.LOG_DAEMON, 0)
+	writer, err := syslog.New(syslog.LOG_WARNING | syslog.LOG_DAEMON, "")
 	if err != nil {
 		log.Printf("Warning: unable to open syslog: %s", err)
-	} else {
-		syslogger = temp
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	syslogWriter = writer
+	syslogger = log.New(writer, "", 0)
+}
+
+// Closes the connection to syslog so that any buffered notifications are delivered before exiting
+func Close() {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if syslogWriter == nil {
+		return
+	}
+
+	syslogger = nil
+	if err := syslogWriter.Close(); err != nil {
+		log.Printf("Unable to close syslog: %s", err)
 	}
 }
 
@@ -41,50 +65,78 @@ func UpdatePoolState(pool string, current *structs.Pool, previous *structs.Pool)
 
 	// Notification 1: Pool wide state change
 	if previous.State != current.State {
-		SendNotification(1, "critical", fmt.Sprintf("Pool \"%s\" state changed: %s -> %s", pool, previous.State, current.State))
+		sendPoolNotification(pool, 1, "critical", fmt.Sprintf("Pool \"%s\" state changed: %s -> %s", pool, previous.State, current.State))
 	}
 
 	// Notification 2: Pool status change
 	if previous.Status != current.Status {
-		SendNotification(2, "warning", fmt.Sprintf("Pool \"%s\" new status: %s", pool, CleanupString(current.Status)))
+		sendPoolNotification(pool, 2, "warning", fmt.Sprintf("Pool \"%s\" new status: %s", pool, CleanupString(current.Status)))
 	}
 
 	// Notification 3: Errors change
 	if previous.Errors != current.Errors {
-		SendNotification(3, "critical", fmt.Sprintf("Pool \"%s\" new errors: %s", pool, current.Errors))
+		sendPoolNotification(pool, 3, "critical", fmt.Sprintf("Pool \"%s\" new errors: %s", pool, current.Errors))
 	}
 
 	// Notification 4: Scrub start
 	// When a scrub starts, the Scanned property will change from 0 (no scrub currently active) to a number that is not 0
 	if previous.Scanned == 0 && current.Scanned != 0 {
-		SendNotification(4, "info", fmt.Sprintf("Pool \"%s\" scrub: started", pool))
+		sendPoolNotification(pool, 4, "info", fmt.Sprintf("Pool \"%s\" scrub: started", pool))
 	}
 
 	// Notification 5: Scrub finish
 	// When a scrub finishes, the Scanned property will change from not 0 (currently scrubbing) to 0
 	if previous.Scanned != 0 && current.Scanned == 0 {
 		// TODO: parse and include how much was resilvered and any errors
-		SendNotification(5, "info", fmt.Sprintf("Pool \"%s\" scrub: completed", pool))
+		sendPoolNotification(pool, 5, "info", fmt.Sprintf("Pool \"%s\" scrub: completed", pool))
 	}
 }
 
+// Sends a notification that isn't about a pool, which is only shown to users who aren't limited to some datasets
 func SendNotification(id int, severity string, message string) {
-	n := structs.Notification {
+	send(structs.Notification {
 		ID: id,
 		Timestamp: time.Now(),
 		Severity: severity,
 		Message: message,
-	}
+	})
+}
 
-	Notifications = append(Notifications, n)
+func sendPoolNotification(pool string, id int, severity string, message string) {
+	send(structs.Notification {
+		ID: id,
+		Timestamp: time.Now(),
+		Severity: severity,
+		Message: message,
+		Pool: pool,
+	})
+}
 
+func send(n structs.Notification) {
 	log.Printf("Got notification %s", n.String())
 
+	lock.Lock()
+	defer lock.Unlock()
+
+	sent = append(sent, n)
+
 	if syslogger != nil {
 		syslogger.Printf("Notification %s", n)
 	}
 }
 
+// Returns a copy of every notification sent so far
+func List() []structs.Notification {
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Make a slice with length 0 so it encodes as [] and not null
+	list := make([]structs.Notification, len(sent))
+	copy(list, sent)
+
+	return list
+}
+
 func CleanupString(raw string) string {
 	// TODO: replace with regex
 	raw = strings.ReplaceAll(raw, "\r", " ")
@@ -8,4 +8,123 @@ type User struct {
 	Password          string
 	TwoFactorProvider string
 	TwoFactorData     string
-}
\ No newline at end of file
+	Role              string
+}
+
+// Roles that can be assigned to users
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+// Permissions that are checked before running an action
+const (
+	PermView     = "view"		// view pools, datasets, snapshots and notifications
+	PermBrowse   = "browse"		// browse, search, preview and download files
+	PermKeys     = "keys"		// load and unload encryption keys
+	PermMount    = "mount"		// mount and unmount datasets
+	PermMaintain = "maintain"	// start and pause scrubs and trim pools
+	PermAdmin    = "admin"		// manage users
+)
+
+var RolePermissions = map[string][]string {
+	RoleViewer:   { PermView },
+	RoleOperator: { PermView, PermBrowse, PermKeys, PermMount, PermMaintain },
+	RoleAdmin:    { PermView, PermBrowse, PermKeys, PermMount, PermMaintain, PermAdmin },
+}
+
+func IsRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+func RoleHasPermission(role string, perm string) bool {
+	for _, granted := range RolePermissions[role] {
+		if granted == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Personal API token. Times are Unix timestamps and an Expires of zero never expires.
+type Token struct {
+	ID       string
+	Username string
+	Name     string
+	Scopes   []string
+	Created  int64
+	Expires  int64
+	LastUsed int64
+}
+
+func (t Token) HasScope(perm string) bool {
+	for _, scope := range t.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebAuthn authenticator registered as a second factor. ID is the base64url encoded credential ID.
+type WebAuthnCredential struct {
+	ID        string
+	Username  string
+	Name      string
+	PublicKey []byte `json:"-"`
+	SignCount uint32 `json:"-"`
+	Created   int64
+	LastUsed  int64
+}
+
+// Server side login session. ID is the hash of the identifier stored in the session cookie so that listing sessions
+// doesn't reveal anything that could be used to hijack them. Times are Unix timestamps.
+type Session struct {
+	ID        string
+	Username  string
+	Data      []byte `json:"-"`
+	IP        string
+	UserAgent string
+	Created   int64
+	LastSeen  int64
+}
+
+// Maps the subject of a TLS client certificate (such as "CN=backup,O=Example") to the user it authenticates as
+type ClientCertificate struct {
+	Subject  string
+	Username string
+}
+
+// Maps a local user ID connecting over the Unix socket to the Lifeguard user it authenticates as
+type SocketUser struct {
+	UID      uint32
+	Username string
+}
+
+// Record of a state changing action. Time is a Unix timestamp and Result is either "success" or "failure".
+type AuditEntry struct {
+	ID         int64
+	Time       int64
+	Username   string
+	IP         string
+	Action     string
+	Target     string
+	Parameters map[string]string
+	Result     string
+	Stderr     string
+}
+
+// Restricts which audit entries are returned. Empty fields and zero times and limits are not used to filter.
+type AuditFilter struct {
+	Username string
+	Action   string
+	Target   string
+	Result   string
+	Since    int64
+	Until    int64
+	Limit    int
+}
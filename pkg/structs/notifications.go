@@ -8,11 +8,13 @@ import (
 	"time"
 )
 
+// Pool is empty for notifications that aren't about a pool, such as account lockouts
 type Notification struct {
 	ID        int
 	Timestamp time.Time
 	Severity  string
 	Message   string
+	Pool      string `json:",omitempty"`
 }
 
 func (n Notification) String() string {
@@ -0,0 +1,337 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+/* Package webauthn verifies the responses returned by navigator.credentials.create() and navigator.credentials.get().
+ * Only what Lifeguard needs as a second factor is implemented: attestation statements are ignored (credentials are
+ * registered with attestation "none") and ES256, RS256 and EdDSA public keys are supported.
+ */
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Algorithms offered to authenticators when registering, in order of preference
+var Algorithms = []int { AlgES256, AlgEdDSA, AlgRS256 }
+
+// Authenticator data flags
+const (
+	flagUserPresent = 0x01
+	flagAttested    = 0x40
+)
+
+var (
+	ErrChallenge    = errors.New("challenge does not match")
+	ErrOrigin       = errors.New("origin does not match")
+	ErrRelyingParty = errors.New("relying party does not match")
+	ErrUserPresence = errors.New("user was not present")
+	ErrSignature    = errors.New("invalid signature")
+	ErrSignCount    = errors.New("signature counter did not increase, authenticator may have been cloned")
+)
+
+// Parsed authenticator data. CredentialID and PublicKey are only set when registering.
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// A newly registered credential. PublicKey is the COSE encoded key, which is what VerifyAssertion expects.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte
+	SignCount uint32
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Format   string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// ASN.1 encoding of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// All binary values in the WebAuthn API are encoded as unpadded base64url when sent as JSON
+func Encode(raw []byte) string {
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func Decode(encoded string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+// Verifies the response to navigator.credentials.create() and returns the new credential
+func VerifyRegistration(clientDataJSON []byte, attestation []byte, challenge []byte, origin string, rpID string) (*Credential, error) {
+	if err := verifyClientData(clientDataJSON, "webauthn.create", challenge, origin); err != nil {
+		return nil, err
+	}
+
+	var obj attestationObject
+	if err := cbor.Unmarshal(attestation, &obj); err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %s", err)
+	}
+
+	data, err := ParseAuthenticatorData(obj.AuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyAuthenticatorData(data, rpID); err != nil {
+		return nil, err
+	}
+
+	if data.Flags & flagAttested == 0 {
+		return nil, errors.New("authenticator data does not contain a credential")
+	}
+
+	// Reject keys that can't be used later on
+	if _, err := parsePublicKey(data.PublicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential {
+		ID:        data.CredentialID,
+		PublicKey: data.PublicKey,
+		SignCount: data.SignCount,
+	}, nil
+}
+
+// Verifies the response to navigator.credentials.get() against a previously registered credential and returns the new
+// signature counter, which should be saved for the next assertion.
+func VerifyAssertion(cred Credential, clientDataJSON []byte, authData []byte, signature []byte, challenge []byte,
+	origin string, rpID string) (uint32, error) {
+
+	if err := verifyClientData(clientDataJSON, "webauthn.get", challenge, origin); err != nil {
+		return 0, err
+	}
+
+	data, err := ParseAuthenticatorData(authData)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := verifyAuthenticatorData(data, rpID); err != nil {
+		return 0, err
+	}
+
+	// The signature covers the authenticator data followed by the hash of the client data
+	hash := sha256.Sum256(clientDataJSON)
+	message := append(append([]byte{}, authData...), hash[:]...)
+
+	if err := verifySignature(cred.PublicKey, message, signature); err != nil {
+		return 0, err
+	}
+
+	// Authenticators that don't implement a counter always return zero
+	if (data.SignCount != 0 || cred.SignCount != 0) && data.SignCount <= cred.SignCount {
+		return 0, ErrSignCount
+	}
+
+	return data.SignCount, nil
+}
+
+func ParseAuthenticatorData(raw []byte) (*AuthenticatorData, error) {
+	// RP ID hash (32), flags (1) and signature counter (4)
+	if len(raw) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+
+	data := &AuthenticatorData {
+		RPIDHash:  raw[:32],
+		Flags:     raw[32],
+		SignCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+
+	if data.Flags & flagAttested == 0 {
+		return data, nil
+	}
+
+	// AAGUID (16) and credential ID length (2)
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < length {
+		return nil, errors.New("credential ID is truncated")
+	}
+
+	data.CredentialID = rest[:length]
+	rest = rest[length:]
+
+	// The public key isn't length prefixed and may be followed by extensions, so decode exactly one item
+	var key cbor.RawMessage
+	if err := cbor.NewDecoder(bytes.NewReader(rest)).Decode(&key); err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %s", err)
+	}
+
+	data.PublicKey = []byte(key)
+
+	return data, nil
+}
+
+func verifyClientData(raw []byte, kind string, challenge []byte, origin string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid client data: %s", err)
+	}
+
+	if data.Type != kind {
+		return fmt.Errorf("expected client data type %s but got %s", kind, data.Type)
+	}
+
+	sent, err := Decode(data.Challenge)
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(sent, challenge) != 1 {
+		return ErrChallenge
+	}
+
+	if data.Origin != origin {
+		return ErrOrigin
+	}
+
+	return nil
+}
+
+func verifyAuthenticatorData(data *AuthenticatorData, rpID string) error {
+	expected := sha256.Sum256([]byte(rpID))
+	if subtle.ConstantTimeCompare(data.RPIDHash, expected[:]) != 1 {
+		return ErrRelyingParty
+	}
+
+	if data.Flags & flagUserPresent == 0 {
+		return ErrUserPresence
+	}
+
+	return nil
+}
+
+// Parses a COSE encoded public key into an *ecdsa.PublicKey, *rsa.PublicKey or ed25519.PublicKey
+func parsePublicKey(raw []byte) (interface{}, error) {
+	var key map[int]interface{}
+	if err := cbor.Unmarshal(raw, &key); err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+
+	alg, _ := coseInt(key[3])
+
+	switch alg {
+	case AlgES256:
+		x, xOk := key[-2].([]byte)
+		y, yOk := key[-3].([]byte)
+		if crv, _ := coseInt(key[-1]); crv != 1 || !xOk || !yOk {
+			return nil, errors.New("invalid ES256 public key")
+		}
+
+		pub := &ecdsa.PublicKey {
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("ES256 public key is not on the curve")
+		}
+
+		return pub, nil
+
+	case AlgRS256:
+		n, nOk := key[-1].([]byte)
+		e, eOk := key[-2].([]byte)
+		if !nOk || !eOk || len(e) > 4 {
+			return nil, errors.New("invalid RS256 public key")
+		}
+
+		return &rsa.PublicKey {
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case AlgEdDSA:
+		x, ok := key[-2].([]byte)
+		if crv, _ := coseInt(key[-1]); crv != 6 || !ok || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid EdDSA public key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+func verifySignature(raw []byte, message []byte, signature []byte) error {
+	key, err := parsePublicKey(raw)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(message)
+	valid := false
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig ecdsaSignature
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 {
+			valid = ecdsa.Verify(pub, hash[:], sig.R, sig.S)
+		}
+
+	case *rsa.PublicKey:
+		valid = (rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) == nil)
+
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, message, signature)
+	}
+
+	if !valid {
+		return ErrSignature
+	}
+
+	return nil
+}
+
+// CBOR integers decode as uint64 when positive and int64 when negative
+func coseInt(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case uint64:
+		return int(v), true
+	case int64:
+		return int(v), true
+	}
+
+	return 0, false
+}
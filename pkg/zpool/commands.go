@@ -7,6 +7,16 @@ package zpool
 const cmdZpool = "/sbin/zpool"
 const cmdZfs   = "/sbin/zfs"
 
+// Subcommands that are given timeout.long instead of timeout.value since they can take a long time on large pools
+var longCommands = map[string]bool {
+	"status":   true,
+	"send":     true,
+	"receive":  true,
+	"load-key": true,
+	"mount":    true,
+	"unmount":  true,
+}
+
 // Basic information retrieval operations
 var cmdGetVersion   = []string { cmdZpool, "version" }
 var cmdPoolStatus   = []string { cmdZpool, "status" }
@@ -4,7 +4,9 @@
 package zpool
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strconv"
 	"strings"
@@ -125,12 +127,18 @@ func ParseZpoolStatus(raw string) *structs.Pool {
 	return pool
 }
 
-func ListZpools() []string {
+func ListZpools(ctx context.Context) ([]string, error) {
 	cmd := append(cmdListPools, "name")
-	return strings.Split(MustExec(cmd), "\n")
+
+	out, err := ExecOutput(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Split(out, "\n"), nil
 }
 
-func GetProperties(name string, which string, filter string, props string) []map[string]*structs.Property {
+func GetProperties(ctx context.Context, name string, which string, filter string, props string) ([]map[string]*structs.Property, error) {
 	var pulled []map[string]*structs.Property
 
 	props = Sanitize(props)
@@ -144,7 +152,7 @@ func GetProperties(name string, which string, filter string, props string) []map
 		cmd = append(cmd, cmdListDatasets...)
 
 	} else {
-		log.Fatalf("Unknown command '%s' for GetProperties", which)
+		return nil, fmt.Errorf("unknown command '%s' for GetProperties", which)
 	}
 
 	cmd = append(cmd, props, name)		// Append properties and pool name
@@ -155,7 +163,10 @@ func GetProperties(name string, which string, filter string, props string) []map
 
 	// This command returns a single line of output with properties delimited by tabs.
 	// The order is determined by the properties passed to the -o flag.
-	output := MustExec(cmd)
+	output, err := ExecOutput(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	if IsTest || config.GetBool("debug.parse", false) {
 		log.Printf("Raw output of %v: '%s'", cmd, output)
@@ -169,6 +180,9 @@ func GetProperties(name string, which string, filter string, props string) []map
 		}
 
 		parsed := strings.Split(line, "\t")
+		if len(parsed) > len(rawProps) {
+			return nil, fmt.Errorf("%v returned %d properties instead of %d", cmd, len(parsed), len(rawProps))
+		}
 
 		for index, prop := range parsed {
 			name := rawProps[index]
@@ -197,15 +211,33 @@ func GetProperties(name string, which string, filter string, props string) []map
 		}
 	}
 
-	return pulled
+	return pulled, nil
+}
+
+// Returns the properties of only the named pool or dataset
+func GetObjectProperties(ctx context.Context, name string, which string, props string) (map[string]*structs.Property, error) {
+	pulled, err := GetProperties(ctx, name, which, "", props)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pulled) == 0 {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+
+	return pulled[0], nil
 }
 
-func ParseAllPools() []*structs.Pool {
+func ParseAllPools(ctx context.Context) ([]*structs.Pool, error) {
 	var pools []*structs.Pool
-	names := ListZpools()
+
+	names, err := ListZpools(ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(names) > 0 && names[0] == "no pools available" {
-		return pools
+		return pools, nil
 	}
 
 	for _, name := range names {
@@ -213,19 +245,32 @@ func ParseAllPools() []*structs.Pool {
 			continue
 		}
 
-		pools = append(pools, ParsePool(name, false))
+		pool, err := ParsePool(ctx, name, false)
+		if err != nil {
+			return nil, err
+		}
+
+		pools = append(pools, pool)
 	}
 
-	return pools
+	return pools, nil
 }
 
-func ParsePool(name string, includeChildren bool) *structs.Pool {
+func ParsePool(ctx context.Context, name string, includeChildren bool) (*structs.Pool, error) {
 	name = Sanitize(name)
 	cmd := append(cmdPoolStatus, name)
-	out := MustExec(cmd)
+
+	out, err := ExecOutput(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
 
 	pool := ParseZpoolStatus(out)
-	pool.Properties = GetProperties(name, "zpool", "", config.GetString("properties.pool", structs.DefaultProperties["pool"]))[0]
+
+	pool.Properties, err = GetObjectProperties(ctx, name, "zpool", config.GetString("properties.pool", structs.DefaultProperties["pool"]))
+	if err != nil {
+		return nil, err
+	}
 
 	/*
 	 * This is optional since parsing all snapshots is expensive if many are present.
@@ -233,74 +278,84 @@ func ParsePool(name string, includeChildren bool) *structs.Pool {
 	 * from less than 50 ms on average to 260 ms.
 	 */
 	if includeChildren {
-		pool.Datasets   = GetProperties(name, "zfs", "filesystem,volume", config.GetString("properties.dataset", structs.DefaultProperties["dataset"]))
-		pool.Snapshots  = GetProperties(name, "zfs", "snapshot", config.GetString("properties.snapshot", structs.DefaultProperties["snapshot"]))
+		pool.Datasets, err = GetProperties(ctx, name, "zfs", "filesystem,volume", config.GetString("properties.dataset", structs.DefaultProperties["dataset"]))
+		if err != nil {
+			return nil, err
+		}
+
+		pool.Snapshots, err = GetProperties(ctx, name, "zfs", "snapshot", config.GetString("properties.snapshot", structs.DefaultProperties["snapshot"]))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return pool
+	return pool, nil
 }
 
-func GetVersion() string {
-	out := MustExec(cmdGetVersion)
+func GetVersion(ctx context.Context) (string, error) {
+	out, err := ExecOutput(ctx, cmdGetVersion)
+	if err != nil {
+		return "", err
+	}
 
 	// The first line is the zfs version, the second is the kernel module version
 	version := strings.Split(out, "\n")[0]
 
-	return version
+	return version, nil
 }
 
-func LoadKey(dataset string, passphrase string) (string, error) {
+func LoadKey(ctx context.Context, dataset string, passphrase string) (string, error) {
 	cmd := append(cmdLoadKey, dataset)
-	_, stderr, err := ExecWithInput(cmd, []byte(passphrase))
+	_, stderr, err := ExecWithInput(ctx, cmd, []byte(passphrase))
 
 	return stderr, err
 }
 
-func UnloadKey(dataset string) (string, error) {
+func UnloadKey(ctx context.Context, dataset string) (string, error) {
 	cmd := append(cmdUnloadKey, dataset)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func Scrub(pool string) (string, error) {
+func Scrub(ctx context.Context, pool string) (string, error) {
 	cmd := append(cmdScrub, pool)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func PauseScrub(pool string) (string, error) {
+func PauseScrub(ctx context.Context, pool string) (string, error) {
 	cmd := append(cmdPauseScrub, pool)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func Mount(dataset string) (string, error) {
+func Mount(ctx context.Context, dataset string) (string, error) {
 	cmd := append(cmdMount, dataset)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func Unmount(dataset string) (string, error) {
+func Unmount(ctx context.Context, dataset string) (string, error) {
 	cmd := append(cmdUnmount, dataset)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func Trim(pool string) (string, error) {
+func Trim(ctx context.Context, pool string) (string, error) {
 	cmd := append(cmdTrim, pool)
-	_, stderr, err := Exec(cmd)
+	_, stderr, err := Exec(ctx, cmd)
 
 	return stderr, err
 }
 
-func Iostat(pool string) (string, error) {
+func Iostat(ctx context.Context, pool string) (string, error) {
 	cmd := append(cmdIostat, pool)
-	stdout, _, err := Exec(cmd)
+	stdout, _, err := Exec(ctx, cmd)
 
 	return stdout, err
 }
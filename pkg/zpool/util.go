@@ -5,50 +5,240 @@ package zpool
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
 )
 
-func ExecWithInput(raw []string, stdin []byte) (string, string, error) {
-	return execInternal(raw, stdin)
+// Returned (wrapped) when a command fails because the pool or dataset doesn't exist
+var ErrNotFound = errors.New("pool or dataset not found")
+
+// Returned (wrapped) when a command takes longer than its timeout
+var ErrTimeout = errors.New("command timed out")
+
+// How long a command is given to exit after being asked to before it is killed
+const killGracePeriod = 2 * time.Second
+
+// Describes a command that couldn't be run or didn't succeed. ExitCode is -1 if the command didn't exit normally (for
+// example because it was killed). Err wraps ErrNotFound, ErrTimeout or the request's context error where applicable.
+type ExecError struct {
+	Command  []string
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %s", strings.Join(e.Command, " "), e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+
+	return msg
 }
 
-func Exec(raw []string) (string, string, error) {
-	return execInternal(raw, []byte(""))
+func (e *ExecError) Unwrap() error {
+	return e.Err
 }
 
-func MustExec(raw []string) string {
-	stdout, _, err := Exec(raw)
-	if err != nil {
-		log.Fatalf("Unable to exec %s: %s", raw, err)
+// Runs the command with stdin. The command is killed if ctx is cancelled (such as when the HTTP client disconnects)
+// or when the command's timeout passes. Errors are always an *ExecError.
+func ExecWithInput(ctx context.Context, raw []string, stdin []byte) (string, string, error) {
+	return execInternal(ctx, raw, stdin)
+}
+
+func Exec(ctx context.Context, raw []string) (string, string, error) {
+	return execInternal(ctx, raw, []byte(""))
+}
+
+// Runs the command and returns its stdout. If the command fails, the error includes its stderr.
+func ExecOutput(ctx context.Context, raw []string) (string, error) {
+	stdout, _, err := Exec(ctx, raw)
+	return stdout, err
+}
+
+// Returns how long raw may run. Commands that can take a long time on large pools (such as status, which also reports
+// scrub progress) get timeout.long seconds and everything else gets timeout.value seconds. The browser is only limited
+// by the request since it streams archives of any size.
+func commandTimeout(raw []string) time.Duration {
+	if raw[0] == "./browser" {
+		return 0
+	}
+
+	short := config.GetString("timeout.value", "4")
+	long := config.GetString("timeout.long", "600")
+
+	// Skip sudo and its flags to find the zfs subcommand
+	sub := ""
+	for i, arg := range raw {
+		if (arg == cmdZpool || arg == cmdZfs) && i + 1 < len(raw) {
+			sub = raw[i + 1]
+			break
+		}
 	}
 
-	return stdout
+	timeout := short
+	if longCommands[sub] {
+		timeout = long
+	}
+
+	seconds, err := strconv.Atoi(timeout)
+	if err != nil || seconds <= 0 {
+		log.Printf("Invalid command timeout %s, using 4 seconds", timeout)
+		seconds = 4
+	}
+
+	return time.Duration(seconds) * time.Second
 }
 
-func execInternal(raw []string, stdin []byte) (string, string, error) {
-	var stdout, stderr bytes.Buffer
+// Returns a context for running raw that is cancelled when ctx is or when the command's timeout passes
+func commandContext(ctx context.Context, raw []string) (context.Context, context.CancelFunc) {
+	if timeout := commandTimeout(raw); timeout != 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// Starts cmd and stops it when ctx is cancelled. The command runs in its own process group so that anything it
+// started is also stopped. SIGTERM is sent first since sudo forwards it to the root owned command it runs, which
+// Lifeguard isn't allowed to signal directly. The returned function must be called once cmd.Wait returns.
+func startCommand(ctx context.Context, cmd *exec.Cmd) (func(), error) {
+	cmd.SysProcAttr = &syscall.SysProcAttr { Setpgid: true }
 
-	if raw[0] != "./browser" {
-		raw = append([]string { config.GetString("timeout.path", "/usr/bin/timeout"), config.GetString("timeout.value", "4") }, raw...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
 	}
-	
+
+	done := make(chan struct{})
+	pgid := -cmd.Process.Pid
+
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+
+		syscall.Kill(pgid, syscall.SIGTERM)
+
+		select {
+		case <-done:
+		case <-time.After(killGracePeriod):
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+
+	return func() { close(done) }, nil
+}
+
+// Converts the result of running raw into an *ExecError, or nil if the command succeeded
+func commandError(ctx context.Context, raw []string, stderr string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	execErr := &ExecError {
+		Command:  raw,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(stderr),
+		Err:      err,
+	}
+
+	if exit, ok := err.(*exec.ExitError); ok {
+		execErr.ExitCode = exit.ExitCode()
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		execErr.Err = ErrTimeout
+	} else if ctx.Err() != nil {
+		execErr.Err = ctx.Err()
+	} else if strings.Contains(execErr.Stderr, "no such pool") || strings.Contains(execErr.Stderr, "does not exist") {
+		execErr.Err = ErrNotFound
+	}
+
+	return execErr
+}
+
+// Runs the command and passes its stdout to handler as it is produced instead of buffering it. This is used for output
+// that is too large to hold in memory, such as directory archives from the browser. Returns stderr and the first error.
+func ExecStream(ctx context.Context, raw []string, handler func(stdout io.Reader) error) (string, error) {
+	var stderr bytes.Buffer
+
+	ctx, cancel := commandContext(ctx, raw)
+	defer cancel()
+
+	cmd := buildCommand(raw)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", commandError(ctx, raw, "", err)
+	}
+
+	finished, err := startCommand(ctx, cmd)
+	if err != nil {
+		return "", commandError(ctx, raw, "", err)
+	}
+	defer finished()
+
+	if handlerErr := handler(stdout); handlerErr != nil {
+		// The reader has gone away (usually the HTTP client disconnected) so there is no reason to let the command finish
+		cancel()
+		cmd.Wait()
+
+		return string(stderr.Bytes()), handlerErr
+	}
+
+	// Consume anything the handler didn't read so the command isn't blocked writing to a full pipe
+	io.Copy(ioutil.Discard, stdout)
+
+	err = cmd.Wait()
+	return string(stderr.Bytes()), commandError(ctx, raw, string(stderr.Bytes()), err)
+}
+
+func buildCommand(raw []string) *exec.Cmd {
 	cmd := exec.Command(raw[0], raw[1:]...)
 
 	if config.GetBool("debug.exec", false) {
 		log.Printf("Executing command: %v", cmd)
 	}
 
+	return cmd
+}
+
+func execInternal(ctx context.Context, raw []string, stdin []byte) (string, string, error) {
+	var stdout, stderr bytes.Buffer
+
+	ctx, cancel := commandContext(ctx, raw)
+	defer cancel()
+
+	cmd := buildCommand(raw)
 	cmd.Stdin = bytes.NewBuffer(stdin)
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		return "", string(stderr.Bytes()), err
+	finished, err := startCommand(ctx, cmd)
+	if err != nil {
+		return "", "", commandError(ctx, raw, "", err)
+	}
+
+	err = cmd.Wait()
+	finished()
+
+	if err != nil {
+		return "", string(stderr.Bytes()), commandError(ctx, raw, string(stderr.Bytes()), err)
 	}
 
 	return string(stdout.Bytes()), string(stderr.Bytes()), nil
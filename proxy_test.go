@@ -0,0 +1,114 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+// Trusts proxies (a proxy.trusted value) until the returned function is called
+func trustProxies(proxies string) func() {
+	config.Set("proxy.trusted", proxies)
+	api.ReloadConfig()
+
+	return func() {
+		config.Set("proxy.trusted", "")
+		config.Set("proxy.auth_header", "")
+		api.ReloadConfig()
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	defer trustProxies("192.0.2.60, 198.51.100.0/24")()
+
+	router := api.NewRouter()
+	admin := adminSession(t, router, "proxy-admin")
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		ip        string
+	}{
+		{ "direct", "192.0.2.61:1234", nil, "192.0.2.61" },
+		{ "untrusted proxy", "192.0.2.61:1234", []string { "203.0.113.1" }, "192.0.2.61" },
+		{ "trusted proxy", "192.0.2.60:1234", []string { "203.0.113.2" }, "203.0.113.2" },
+		{ "no header", "192.0.2.60:1234", nil, "192.0.2.60" },
+		{ "chain", "192.0.2.60:1234", []string { "203.0.113.3, 198.51.100.7" }, "203.0.113.3" },
+		{ "spoofed", "192.0.2.60:1234", []string { "10.0.0.1, 203.0.113.4" }, "203.0.113.4" },
+		{ "multiple headers", "192.0.2.60:1234", []string { "10.0.0.2", "203.0.113.5" }, "203.0.113.5" },
+		{ "invalid hop", "192.0.2.60:1234", []string { "nonsense" }, "192.0.2.60" },
+		{ "invalid hop in chain", "192.0.2.60:1234", []string { "203.0.113.6, nonsense, 198.51.100.8" }, "198.51.100.8" },
+	}
+
+	for i, test := range tests {
+		// The address is read back from the audit entry of a failed login
+		target := fmt.Sprintf("proxy-user-%d", i)
+		form := url.Values { "Username": { target }, "Password": { "wrong" } }
+
+		r := newRequest("POST", "/api/v0/authenticate", test.remote, form, csrfHeaders())
+		r.Header["X-Forwarded-For"] = test.forwarded
+		router.ServeHTTP(httptest.NewRecorder(), r)
+
+		var entries []structs.AuditEntry
+		w := serve(router, "GET", "/api/v0/audit?target=" + target, "192.0.2.99:1234", nil,
+			map[string]string { "Cookie": admin })
+		json.NewDecoder(w.Body).Decode(&entries)
+
+		if len(entries) != 1 {
+			t.Errorf("Error testing %s - expected 1 audit entry but found %d", test.name, len(entries))
+			continue
+		}
+
+		areEqual(test.name, test.ip, entries[0].IP, t)
+	}
+}
+
+func TestForwardedProto(t *testing.T) {
+	defer trustProxies("192.0.2.60")()
+
+	router := api.NewRouter()
+
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		hsts   bool
+	}{
+		{ "plain", "192.0.2.60:1234", "", false },
+		{ "trusted https", "192.0.2.60:1234", "https", true },
+		{ "trusted http", "192.0.2.60:1234", "http", false },
+		{ "untrusted https", "192.0.2.61:1234", "https", false },
+	}
+
+	for _, test := range tests {
+		w := serve(router, "GET", "/api/v0/info", test.remote, nil, map[string]string { "X-Forwarded-Proto": test.proto })
+		areEqual(test.name, test.hsts, w.Header().Get("Strict-Transport-Security") != "", t)
+
+		// Cookies set over HTTPS are marked secure
+		for _, cookie := range w.Result().Cookies() {
+			areEqual(test.name + " secure cookie", test.hsts, cookie.Secure, t)
+		}
+	}
+}
+
+func TestInvalidProxy(t *testing.T) {
+	defer trustProxies("192.0.2.60")()
+
+	// An invalid setting keeps the previous proxies
+	config.Set("proxy.trusted", "not-an-address")
+	api.ReloadConfig()
+
+	router := api.NewRouter()
+	w := serve(router, "GET", "/api/v0/info", "192.0.2.60:1234", nil, map[string]string { "X-Forwarded-Proto": "https" })
+	areEqual("previous proxies kept", true, w.Header().Get("Strict-Transport-Security") != "", t)
+}
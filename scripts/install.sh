@@ -43,5 +43,49 @@ chmod 4555 browser
 chown root config/browser.ini
 chmod 0600 config/browser.ini
 
+# =========== systemd service ===========
+log "Installing systemd service as lifeguard.service"
+dir="$(pwd)"
+
+# NoNewPrivileges, ProtectSystem and RestrictSUIDSGID are deliberately not set since zfs is run through sudo and the
+# browser binary is SUID root
+cat > /etc/systemd/system/lifeguard.service << EOF
+[Unit]
+Description=Lifeguard ZFS manager
+Wants=network-online.target zfs.target
+After=network-online.target zfs.target
+
+[Service]
+Type=notify
+NotifyAccess=main
+User=$user
+WorkingDirectory=$dir
+ExecStart=$dir/lifeguard
+ExecReload=/bin/kill -HUP \$MAINPID
+Restart=on-failure
+WatchdogSec=30
+TimeoutStopSec=45
+
+PrivateTmp=true
+ProtectKernelTunables=true
+ProtectKernelModules=true
+ProtectKernelLogs=true
+ProtectControlGroups=true
+ProtectHostname=true
+ProtectClock=true
+RestrictRealtime=true
+RestrictNamespaces=true
+LockPersonality=true
+SystemCallArchitectures=native
+UMask=0077
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl daemon-reload
+log "Run $dir/lifeguard once as $user to set the admin password, then start the service with:"
+log "    systemctl enable --now lifeguard"
+
 # =========== done ===========
 log "Installation successful"
\ No newline at end of file
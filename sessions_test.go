@@ -0,0 +1,178 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestSessionNotStoredBeforeLogin(t *testing.T) {
+	store := api.NewSessionStore([]byte("0123456789ABCDEF0123456789ABCDEF"), time.Hour, time.Hour)
+
+	r := httptest.NewRequest("POST", "/api/v0/authenticate", nil)
+	w := httptest.NewRecorder()
+
+	session, _ := store.Get(r, "session")
+	session.Values["authenticated"] = false
+	session.Values["username"] = ""
+
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Unable to save session: %s", err)
+	}
+
+	stored, _ := config.GetSessions("")
+	areEqual("anonymous sessions", 0, len(stored), t)
+	areEqual("anonymous session id", "", session.ID, t)
+
+	r = httptest.NewRequest("POST", "/api/v0/authenticate", nil)
+	w = httptest.NewRecorder()
+
+	session, _ = store.Get(r, "session")
+	session.Values["authenticated"] = true
+	session.Values["username"] = "session-user"
+
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Unable to save session: %s", err)
+	}
+
+	stored, _ = config.GetSessions("session-user")
+	areEqual("authenticated sessions", 1, len(stored), t)
+}
+
+// Logs in as username and returns the session cookie ("SESSION=...")
+func login(t *testing.T, router http.Handler, username string, password string, remote string) string {
+	form := url.Values { "Username": { username }, "Password": { password } }
+
+	w := serve(router, "POST", "/api/v0/authenticate", remote, form, csrfHeaders())
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unable to log in as %s: %d %s", username, w.Code, w.Body.String())
+	}
+
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "SESSION" {
+			return cookie.Name + "=" + cookie.Value
+		}
+	}
+
+	t.Fatalf("No session cookie was set for %s", username)
+	return ""
+}
+
+// Creates an administrator named username (if it doesn't exist) and logs in as it. Administrative routes can't be used
+// with API tokens, so tests of them need a session instead. Returns the session cookie.
+func adminSession(t *testing.T, router http.Handler, username string) string {
+	if !config.IsUser(username) {
+		if err := config.CreateUser(username, crypto.HashPassword("password"), structs.RoleAdmin, nil); err != nil {
+			t.Fatalf("Unable to create user %s: %s", username, err)
+		}
+	}
+
+	return login(t, router, username, "password", "192.0.2.98:1234")
+}
+
+// Returns the sessions visible to the session in cookie and the status code
+func listSessions(router http.Handler, cookie string) ([]api.SessionInfo, int) {
+	var list []api.SessionInfo
+
+	w := serve(router, "GET", "/api/v0/sessions", "192.0.2.3:1234", nil, map[string]string { "Cookie": cookie })
+	json.NewDecoder(w.Body).Decode(&list)
+
+	return list, w.Code
+}
+
+func TestSessionRevocation(t *testing.T) {
+	router := api.NewRouter()
+	config.CreateUser("revoke-user", crypto.HashPassword("password"), structs.RoleViewer, nil)
+
+	first := login(t, router, "revoke-user", "password", "192.0.2.3:1234")
+	second := login(t, router, "revoke-user", "password", "192.0.2.3:1234")
+
+	list, status := listSessions(router, first)
+	areEqual("list status", http.StatusOK, status, t)
+	areEqual("sessions", 2, len(list), t)
+
+	// Revoke the second session from the first one
+	var id string
+	for _, session := range list {
+		if !session.Current {
+			id = session.ID
+		}
+	}
+
+	w := serve(router, "POST", "/api/v0/sessions/" + id + "/revoke", "192.0.2.3:1234", nil, csrfHeaders(first))
+	areEqual("revoke", http.StatusOK, w.Code, t)
+
+	_, status = listSessions(router, second)
+	areEqual("revoked session", http.StatusForbidden, status, t)
+
+	list, status = listSessions(router, first)
+	areEqual("remaining status", http.StatusOK, status, t)
+	areEqual("remaining sessions", 1, len(list), t)
+
+	// Other users can't revoke the session through their own endpoint
+	config.CreateUser("revoke-other", crypto.HashPassword("password"), structs.RoleViewer, nil)
+	other := login(t, router, "revoke-other", "password", "192.0.2.3:1234")
+
+	w = serve(router, "POST", "/api/v0/sessions/" + list[0].ID + "/revoke", "192.0.2.3:1234", nil, csrfHeaders(other))
+	areEqual("revoke other user's session", http.StatusNotFound, w.Code, t)
+
+	_, status = listSessions(router, first)
+	areEqual("other user's session kept", http.StatusOK, status, t)
+
+	config.RevokeSessions("revoke-user", "")
+	_, status = listSessions(router, first)
+	areEqual("revoke all", http.StatusForbidden, status, t)
+}
+
+// Returns the session cookie set by w or an empty string
+func sessionCookie(w *httptest.ResponseRecorder) string {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "SESSION" && cookie.Value != "" {
+			return cookie.Name + "=" + cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// Completing the second factor must start a new session just like completing the first factor does
+func TestSessionRenewedAfterTwoFactor(t *testing.T) {
+	router := api.NewRouter()
+	config.CreateUser("renew-user", crypto.HashPassword("password"), structs.RoleViewer, nil)
+
+	cred := structs.WebAuthnCredential { ID: "renew-user-key", Username: "renew-user", PublicKey: []byte("key") }
+	if err := config.SaveWebAuthnCredential(cred); err != nil {
+		t.Fatalf("Unable to save credential: %s", err)
+	}
+	config.SetRecoveryCodes("renew-user", []string { crypto.HashToken("abcdefghij") })
+
+	partial := login(t, router, "renew-user", "password", "192.0.2.4:1234")
+
+	form := url.Values { "code": { "abcde-fghij" } }
+	w := serve(router, "POST", "/api/v0/tfa/recovery/authenticate", "192.0.2.4:1234", form, csrfHeaders(partial))
+	areEqual("challenge", http.StatusOK, w.Code, t)
+
+	full := sessionCookie(w)
+	areEqual("new cookie", true, full != "" && full != partial, t)
+
+	_, status := listSessions(router, full)
+	areEqual("new session", http.StatusOK, status, t)
+
+	_, status = listSessions(router, partial)
+	areEqual("old session", http.StatusForbidden, status, t)
+
+	// The old identifier can't be used to resume the partial login either
+	w = serve(router, "GET", "/api/v0/tfa/challenge", "192.0.2.4:1234", nil, map[string]string { "Cookie": partial })
+	areEqual("old partial login", http.StatusForbidden, w.Code, t)
+}
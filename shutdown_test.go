@@ -0,0 +1,86 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+)
+
+// Starts a server whose handler signals started and then blocks until release is closed. Returns the server and the
+// channel that receives the response body (or the error) of a single request made to it.
+func startBlockingServer(t *testing.T, started chan struct{}, release chan struct{}) (*http.Server, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	srv := &http.Server {
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		}),
+	}
+	go srv.Serve(listener)
+
+	responses := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+
+		responses <- string(body)
+	}()
+
+	<-started
+	return srv, responses
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv, responses := startBlockingServer(t, started, release)
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- api.ShutdownServers([]*http.Server { srv }, time.Minute)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Shutdown finished while a request was still running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	areEqual("finished", true, <-done, t)
+	areEqual("response", "done", <-responses, t)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	srv, responses := startBlockingServer(t, started, release)
+
+	// Requests that are still running after the timeout are cut off
+	areEqual("finished", false, api.ShutdownServers([]*http.Server { srv }, 50 * time.Millisecond), t)
+	areEqual("response", true, <-responses != "done", t)
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestSocketPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lifeguard-socket")
+	if err != nil {
+		t.Fatalf("Unable to create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lifeguard.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Unable to listen on %s: %s", path, err)
+	}
+
+	srv := &http.Server {
+		Handler:     api.NewRouter(),
+		ConnContext: api.PeerContext,
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	client := &http.Client {
+		Transport: &http.Transport {
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	status := func(method string, path string) int {
+		req, _ := http.NewRequest(method, "http://lifeguard" + path, nil)
+
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to %s %s: %s", method, path, err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	uid := uint32(os.Getuid())
+	config.DeleteSocketUser(uid)
+	areEqual("unmapped", http.StatusForbidden, status("GET", "/api/v0/properties/Datasets"), t)
+
+	config.CreateUser("socket-user", "", structs.RoleViewer, nil)
+	config.SetSocketUser(uid, "socket-user")
+
+	areEqual("mapped", http.StatusOK, status("GET", "/api/v0/properties/Datasets"), t)
+	areEqual("role still applies", http.StatusForbidden, status("GET", "/api/v0/lockouts"), t)
+
+	// Browsers can't connect to the socket so it doesn't need CSRF tokens
+	areEqual("no csrf token", http.StatusOK, status("POST", "/api/v0/logout"), t)
+
+	config.SetRole("socket-user", structs.RoleAdmin)
+	areEqual("admin", http.StatusOK, status("GET", "/api/v0/lockouts"), t)
+
+	config.DeleteUser("socket-user")
+	areEqual("deleted user", http.StatusForbidden, status("GET", "/api/v0/properties/Datasets"), t)
+
+	config.DeleteSocketUser(uid)
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestSSOHeader(t *testing.T) {
+	config.Set("proxy.auth_header", "X-Remote-User")
+	defer trustProxies("192.0.2.70")()
+	defer config.Set("proxy.auto_provision", "false")
+
+	router := api.NewRouter()
+	config.CreateUser("sso-user", "", structs.RoleViewer, nil)
+
+	tests := []struct {
+		name      string
+		remote    string
+		user      string
+		provision bool
+		status    int
+	}{
+		{ "trusted proxy", "192.0.2.70:1234", "sso-user", false, http.StatusOK },
+		{ "untrusted proxy", "192.0.2.71:1234", "sso-user", false, http.StatusForbidden },
+		{ "no header", "192.0.2.70:1234", "", false, http.StatusForbidden },
+		{ "whitespace", "192.0.2.70:1234", "sso user", false, http.StatusForbidden },
+		{ "unknown user", "192.0.2.70:1234", "sso-new", false, http.StatusForbidden },
+		{ "provisioned", "192.0.2.70:1234", "sso-new", true, http.StatusOK },
+		{ "not provisioned by untrusted proxy", "192.0.2.71:1234", "sso-untrusted", true, http.StatusForbidden },
+	}
+
+	for _, test := range tests {
+		config.Set("proxy.auto_provision", strconv.FormatBool(test.provision))
+
+		w := serve(router, "GET", "/api/v0/properties/Datasets", test.remote, nil, map[string]string { "X-Remote-User": test.user })
+		areEqual(test.name, test.status, w.Code, t)
+	}
+
+	areEqual("provisioned role", structs.RoleViewer, config.GetRole("sso-new"), t)
+	areEqual("untrusted not provisioned", false, config.IsUser("sso-untrusted"), t)
+
+	// The header is ignored once single sign on is turned off
+	config.Set("proxy.auth_header", "")
+	api.ReloadConfig()
+
+	w := serve(router, "GET", "/api/v0/properties/Datasets", "192.0.2.70:1234", nil, map[string]string { "X-Remote-User": "sso-user" })
+	areEqual("disabled", http.StatusForbidden, w.Code, t)
+}
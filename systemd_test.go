@@ -0,0 +1,134 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+)
+
+// Sets the socket activation variables for count descriptors passed to pid
+func setListenEnv(t *testing.T, pid string, count string) {
+	t.Setenv("LISTEN_PID", pid)
+	t.Setenv("LISTEN_FDS", count)
+	t.Setenv("LISTEN_FDNAMES", "web")
+}
+
+func TestSystemdListeners(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+
+	areEqual("not activated", 0, len(api.SystemdListeners()), t)
+
+	setListenEnv(t, strconv.Itoa(os.Getpid() + 1), "1")
+	areEqual("other process", 0, len(api.SystemdListeners()), t)
+	areEqual("cleared", "", os.Getenv("LISTEN_FDS"), t)
+
+	setListenEnv(t, self, "none")
+	areEqual("invalid count", 0, len(api.SystemdListeners()), t)
+
+	setListenEnv(t, self, "0")
+	areEqual("no descriptors", 0, len(api.SystemdListeners()), t)
+
+	// Pass a listener the same way systemd would, using a descriptor that no *os.File owns since it is closed after use
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Unable to get listener descriptor: %s", err)
+	}
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatalf("Unable to duplicate listener descriptor: %s", err)
+	}
+
+	start := api.ListenFdsStart
+	defer func() { api.ListenFdsStart = start }()
+	api.ListenFdsStart = fd
+
+	setListenEnv(t, self, "1")
+	inherited := api.SystemdListeners()
+
+	if len(inherited) != 1 {
+		t.Fatalf("Expected 1 inherited listener but found %d", len(inherited))
+	}
+	defer inherited[0].Close()
+
+	areEqual("address", listener.Addr().String(), inherited[0].Addr().String(), t)
+	areEqual("cleared pid", "", os.Getenv("LISTEN_PID"), t)
+	areEqual("cleared names", "", os.Getenv("LISTEN_FDNAMES"), t)
+}
+
+// Listens for notifications on a unixgram socket at path and returns the first one sent after notify runs
+func receiveNotification(t *testing.T, path string, notify func()) string {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr { Name: path, Net: "unixgram" })
+	if err != nil {
+		t.Fatalf("Unable to listen on %s: %s", path, err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	notify()
+
+	buf := make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Unable to read notification: %s", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestSystemdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	areEqual("path", "READY=1", receiveNotification(t, path, func() { api.SystemdNotify("READY=1") }), t)
+
+	abstract := fmt.Sprintf("@lifeguard-test-%d", os.Getpid())
+	areEqual("abstract", "STOPPING=1", receiveNotification(t, abstract, func() { api.SystemdNotify("STOPPING=1") }), t)
+
+	// Without a socket, notifications are silently skipped
+	t.Setenv("NOTIFY_SOCKET", "")
+	api.SystemdNotify("READY=1")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	other := strconv.Itoa(os.Getpid() + 1)
+
+	tests := []struct {
+		name     string
+		usec     string
+		pid      string
+		expected time.Duration
+	}{
+		{ "disabled", "", "", 0 },
+		{ "enabled", "30000000", "", 30 * time.Second },
+		{ "this process", "30000000", self, 30 * time.Second },
+		{ "other process", "30000000", other, 0 },
+		{ "invalid", "thirty", "", 0 },
+		{ "negative", "-1", "", 0 },
+	}
+
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+
+		areEqual(test.name, test.expected, api.WatchdogInterval(), t)
+	}
+}
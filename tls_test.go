@@ -0,0 +1,126 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+)
+
+func TestFingerprint(t *testing.T) {
+	expected := "9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08"
+	areEqual("fingerprint", expected, api.Fingerprint([]byte("test")), t)
+}
+
+func TestEnsureCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	if err := api.EnsureCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %s", err)
+	}
+
+	areEqual("localhost", nil, cert.VerifyHostname("localhost"), t)
+	areEqual("loopback", nil, cert.VerifyHostname("127.0.0.1"), t)
+	areEqual("valid now", true, time.Now().After(cert.NotBefore) && time.Now().Before(cert.NotAfter), t)
+
+	info, _ := os.Stat(keyFile)
+	areEqual("key permissions", os.FileMode(0600), info.Mode().Perm(), t)
+
+	// Existing certificates are left alone
+	original, _ := ioutil.ReadFile(certFile)
+	if err := api.EnsureCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("Unable to check certificate: %s", err)
+	}
+
+	current, _ := ioutil.ReadFile(certFile)
+	areEqual("kept", true, bytes.Equal(original, current), t)
+
+	// Both files are replaced if either one is missing so that they always match
+	os.Remove(keyFile)
+	if err := api.EnsureCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("Unable to replace certificate: %s", err)
+	}
+
+	current, _ = ioutil.ReadFile(certFile)
+	areEqual("replaced", false, bytes.Equal(original, current), t)
+
+	_, err = tls.LoadX509KeyPair(certFile, keyFile)
+	areEqual("replaced pair", nil, err, t)
+
+	missing := filepath.Join(dir, "missing", "tls.crt")
+	areEqual("missing directory", true, api.EnsureCertificate(missing, keyFile + ".new") != nil, t)
+}
+
+// Replaces the certificate and key with a new pair that appears to have been modified in the future, so that the
+// change is detected even on file systems with coarse timestamps
+func replaceCertificate(t *testing.T, certFile string, keyFile string) {
+	os.Remove(certFile)
+	os.Remove(keyFile)
+
+	if err := api.EnsureCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+
+	_, err := api.NewCertReloader(certFile, keyFile)
+	areEqual("missing certificate", true, err != nil, t)
+
+	api.EnsureCertificate(certFile, keyFile)
+	reloader, err := api.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unable to load certificate: %s", err)
+	}
+
+	original, _ := reloader.GetCertificate(nil)
+
+	// Changes aren't checked for until the interval has passed
+	replaceCertificate(t, certFile, keyFile)
+	current, _ := reloader.GetCertificate(nil)
+	areEqual("before interval", original, current, t)
+
+	interval := api.CertCheckInterval
+	defer func() { api.CertCheckInterval = interval }()
+	api.CertCheckInterval = 0
+
+	current, _ = reloader.GetCertificate(nil)
+	areEqual("reloaded", false, bytes.Equal(original.Certificate[0], current.Certificate[0]), t)
+
+	// A certificate that can't be loaded is ignored and the previous one is still served
+	reloaded := current
+	future := time.Now().Add(2 * time.Minute)
+	ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	os.Chtimes(certFile, future, future)
+
+	current, _ = reloader.GetCertificate(nil)
+	areEqual("invalid certificate", reloaded, current, t)
+}
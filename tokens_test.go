@@ -0,0 +1,102 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestTokenScopes(t *testing.T) {
+	router := api.NewRouter()
+
+	viewOnly := newToken(t, "token-admin", structs.RoleAdmin, structs.PermView)
+	maintainOnly := newToken(t, "token-admin", structs.RoleAdmin, structs.PermMaintain)
+	adminOnly := newToken(t, "token-admin", structs.RoleAdmin, structs.PermAdmin)
+	viewer := newToken(t, "token-viewer", structs.RoleViewer, structs.PermView, structs.PermMaintain)
+
+	tests := []struct {
+		name   string
+		auth   string
+		method string
+		path   string
+		status int
+	}{
+		// Trimming a pool that doesn't exist fails after the permission check with a 400
+		{ "scope granted", viewOnly, "GET", "/api/v0/properties/Datasets", http.StatusOK },
+		{ "scope missing", viewOnly, "POST", "/api/v0/pool/missing/trim", http.StatusForbidden },
+		{ "maintain scope", maintainOnly, "POST", "/api/v0/pool/missing/trim", http.StatusBadRequest },
+		{ "maintain scope without view", maintainOnly, "GET", "/api/v0/properties/Datasets", http.StatusForbidden },
+		{ "scope beyond role", viewer, "POST", "/api/v0/pool/missing/trim", http.StatusForbidden },
+
+		// Tokens can't manage tokens, sessions, users or lockouts or read the audit log even with the admin scope
+		{ "list tokens", adminOnly, "GET", "/api/v0/tokens", http.StatusForbidden },
+		{ "create token", adminOnly, "POST", "/api/v0/tokens/create", http.StatusForbidden },
+		{ "list sessions", adminOnly, "GET", "/api/v0/sessions", http.StatusForbidden },
+		{ "reset password", adminOnly, "POST", "/api/v0/users/token-viewer/password", http.StatusForbidden },
+		{ "list lockouts", adminOnly, "GET", "/api/v0/lockouts", http.StatusForbidden },
+		{ "unlock", adminOnly, "POST", "/api/v0/lockouts/unlock", http.StatusForbidden },
+		{ "audit log", adminOnly, "GET", "/api/v0/audit", http.StatusForbidden },
+
+		{ "malformed token", "Bearer lg_nope", "GET", "/api/v0/properties/Datasets", http.StatusUnauthorized },
+		{ "wrong secret", viewOnly + "x", "GET", "/api/v0/properties/Datasets", http.StatusUnauthorized },
+		{ "not bearer", "Basic dXNlcjpwYXNz", "GET", "/api/v0/properties/Datasets", http.StatusUnauthorized },
+	}
+
+	for _, test := range tests {
+		w := serve(router, test.method, test.path, "192.0.2.2:1234", nil, map[string]string { "Authorization": test.auth })
+		areEqual(test.name, test.status, w.Code, t)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	router := api.NewRouter()
+	config.CreateUser("token-expired", "", structs.RoleAdmin, nil)
+
+	token := structs.Token {
+		ID:       crypto.GetRandom(8),
+		Username: "token-expired",
+		Scopes:   []string { structs.PermView },
+		Created:  time.Now().Add(-48 * time.Hour).Unix(),
+		Expires:  time.Now().Add(-time.Hour).Unix(),
+	}
+	secret := crypto.GetRandom(32)
+
+	if err := config.SaveToken(token, crypto.HashToken(secret)); err != nil {
+		t.Fatalf("Unable to save token: %s", err)
+	}
+
+	auth := "Bearer lg_" + token.ID + "_" + secret
+	w := serve(router, "GET", "/api/v0/properties/Datasets", "192.0.2.2:1234", nil, map[string]string { "Authorization": auth })
+	areEqual("expired", http.StatusUnauthorized, w.Code, t)
+}
+
+// Account endpoints that reject API tokens must also reject requests that aren't authenticated at all
+func TestRequireSession(t *testing.T) {
+	router := api.NewRouter()
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{ "GET", "/api/v0/sessions" },
+		{ "GET", "/api/v0/tokens" },
+		{ "GET", "/api/v0/tfa/recovery" },
+		{ "GET", "/api/v0/tfa/webauthn/credentials" },
+		{ "GET", "/api/v0/tfa/webauthn/register" },
+		{ "POST", "/api/v0/tfa/webauthn/register" },
+		{ "GET", "/api/v0/tfa/totp/initialize" },
+	}
+
+	for _, test := range tests {
+		w := serve(router, test.method, test.path, "192.0.2.2:1234", nil, csrfHeaders())
+		areEqual(test.method + " " + test.path, http.StatusForbidden, w.Code, t)
+	}
+}
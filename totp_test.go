@@ -0,0 +1,117 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestTOTP(t *testing.T) {
+	config.CreateUser("totp-user", "", structs.RoleViewer, nil)
+
+	secret := "JBSWY3DPEHPK3PXP"
+	code, _ := totp.GenerateCode(secret, time.Now())
+
+	ok, err := config.SaveTOTP("totp-user", secret, "000000x")
+	areEqual("save with wrong code", false, ok, t)
+	areEqual("save with wrong code error", nil, err, t)
+
+	ok, _ = config.SaveTOTP("totp-user", secret, code)
+	areEqual("save", true, ok, t)
+
+	provider, _ := config.GetTwoFactorProvider("totp-user")
+	areEqual("provider", "totp", provider, t)
+
+	// The code used during setup was already used
+	ok, _ = config.VerifyTOTP("totp-user", code)
+	areEqual("replayed setup code", false, ok, t)
+}
+
+// Users without TOTP have an empty secret. The codes it generates must never be accepted.
+func TestTOTPEmptySecret(t *testing.T) {
+	config.CreateUser("webauthn-user", "", structs.RoleViewer, nil)
+
+	code, err := totp.GenerateCode("", time.Now())
+	if err != nil {
+		t.Fatalf("Unable to generate code: %s", err)
+	}
+
+	provider, _ := config.GetTwoFactorProvider("webauthn-user")
+	areEqual("provider", "", provider, t)
+
+	ok, _ := config.VerifyTOTP("webauthn-user", code)
+	areEqual("empty secret", false, ok, t)
+
+	ok, _ = config.SaveTOTP("webauthn-user", "", code)
+	areEqual("save empty secret", false, ok, t)
+}
+
+func TestUnknownUser(t *testing.T) {
+	_, err := config.GetTwoFactorProvider("nobody")
+	areEqual("unknown user", true, errors.Is(err, config.ErrUnknownUser), t)
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	config.CreateUser("recovery-user", "", structs.RoleViewer, nil)
+	config.CreateUser("recovery-other", "", structs.RoleViewer, nil)
+
+	hashes := []string { crypto.HashToken("aaaaabbbbb"), crypto.HashToken("cccccddddd") }
+	if err := config.SetRecoveryCodes("recovery-user", hashes); err != nil {
+		t.Fatalf("Unable to save recovery codes: %s", err)
+	}
+
+	count, _ := config.CountRecoveryCodes("recovery-user")
+	areEqual("count", 2, count, t)
+
+	ok, _ := config.UseRecoveryCode("recovery-other", hashes[0])
+	areEqual("other user's code", false, ok, t)
+
+	ok, _ = config.UseRecoveryCode("recovery-user", hashes[0])
+	areEqual("valid code", true, ok, t)
+
+	ok, _ = config.UseRecoveryCode("recovery-user", hashes[0])
+	areEqual("reused code", false, ok, t)
+
+	count, _ = config.CountRecoveryCodes("recovery-user")
+	areEqual("remaining", 1, count, t)
+
+	// Regenerating replaces every existing code
+	config.SetRecoveryCodes("recovery-user", []string { crypto.HashToken("eeeeefffff") })
+
+	ok, _ = config.UseRecoveryCode("recovery-user", hashes[1])
+	areEqual("replaced code", false, ok, t)
+}
+
+// A user with only WebAuthn must not be able to complete the second factor with a TOTP code for the empty secret
+func TestTOTPChallengeWebAuthnOnly(t *testing.T) {
+	router := api.NewRouter()
+	config.CreateUser("webauthn-only", crypto.HashPassword("password"), structs.RoleViewer, nil)
+
+	cred := structs.WebAuthnCredential { ID: "webauthn-only-key", Username: "webauthn-only", PublicKey: []byte("key") }
+	if err := config.SaveWebAuthnCredential(cred); err != nil {
+		t.Fatalf("Unable to save credential: %s", err)
+	}
+
+	session := login(t, router, "webauthn-only", "password", "192.0.2.80:1234")
+
+	code, _ := totp.GenerateCode("", time.Now())
+	form := url.Values { "code": { code } }
+
+	w := serve(router, "POST", "/api/v0/tfa/totp/authenticate", "192.0.2.80:1234", form, csrfHeaders(session))
+	areEqual("challenge", http.StatusForbidden, w.Code, t)
+
+	w = serve(router, "GET", "/api/v0/properties/Datasets", "192.0.2.80:1234", nil, map[string]string { "Cookie": session })
+	areEqual("still partially authenticated", http.StatusForbidden, w.Code, t)
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/api"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/config"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/crypto"
+	"github.com/ConfusedPolarBear/lifeguard/pkg/structs"
+)
+
+func TestUserManagement(t *testing.T) {
+	router := api.NewRouter()
+	admin := adminSession(t, router, "users-admin")
+
+	post := func(path string, form url.Values) int {
+		return serve(router, "POST", path, "192.0.2.50:1234", form, csrfHeaders(admin)).Code
+	}
+
+	// Creating users
+	create := func(username string, password string, role string) int {
+		return post("/api/v0/users/create", url.Values { "Username": { username }, "Password": { password }, "Role": { role } })
+	}
+
+	areEqual("create", http.StatusOK, create("users-new", "password", structs.RoleViewer), t)
+	areEqual("created role", structs.RoleViewer, config.GetRole("users-new"), t)
+	areEqual("create existing", http.StatusConflict, create("users-new", "password", structs.RoleViewer), t)
+	areEqual("create with whitespace", http.StatusBadRequest, create("users new", "password", structs.RoleViewer), t)
+	areEqual("create with short password", http.StatusBadRequest, create("users-short", "short", structs.RoleViewer), t)
+	areEqual("create with unknown role", http.StatusBadRequest, create("users-root", "password", "root"), t)
+	areEqual("create missing parameter", http.StatusBadRequest, post("/api/v0/users/create", url.Values { "Username": { "users-x" } }), t)
+
+	// Changing roles
+	role := func(username string, role string) int {
+		return post("/api/v0/users/" + username + "/role", url.Values { "Role": { role } })
+	}
+
+	areEqual("set role", http.StatusOK, role("users-new", structs.RoleOperator), t)
+	areEqual("changed role", structs.RoleOperator, config.GetRole("users-new"), t)
+	areEqual("set unknown role", http.StatusBadRequest, role("users-new", "root"), t)
+	areEqual("set role of unknown user", http.StatusNotFound, role("users-missing", structs.RoleViewer), t)
+	areEqual("demote self", http.StatusBadRequest, role("users-admin", structs.RoleViewer), t)
+	areEqual("still admin", structs.RoleAdmin, config.GetRole("users-admin"), t)
+
+	// Resetting passwords logs the user out everywhere
+	session := login(t, router, "users-new", "password", "192.0.2.50:1234")
+	reset := func(username string, password string) int {
+		return post("/api/v0/users/" + username + "/password", url.Values { "Password": { password } })
+	}
+
+	areEqual("reset", http.StatusOK, reset("users-new", "new password"), t)
+	_, status := listSessions(router, session)
+	areEqual("session after reset", http.StatusForbidden, status, t)
+	login(t, router, "users-new", "new password", "192.0.2.50:1234")
+
+	areEqual("reset with short password", http.StatusBadRequest, reset("users-new", "short"), t)
+	areEqual("reset unknown user", http.StatusNotFound, reset("users-missing", "password"), t)
+
+	// Administrators have to change their own password with the current one
+	areEqual("reset self", http.StatusBadRequest, reset("users-admin", "new password"), t)
+	login(t, router, "users-admin", "password", "192.0.2.50:1234")
+
+	// Deleting users
+	areEqual("delete", http.StatusOK, post("/api/v0/users/users-new/delete", nil), t)
+	areEqual("deleted", false, config.IsUser("users-new"), t)
+	areEqual("delete unknown user", http.StatusNotFound, post("/api/v0/users/users-new/delete", nil), t)
+	areEqual("delete self", http.StatusBadRequest, post("/api/v0/users/users-admin/delete", nil), t)
+	areEqual("not deleted", true, config.IsUser("users-admin"), t)
+
+	// Only administrators can manage users
+	config.CreateUser("users-viewer", crypto.HashPassword("password"), structs.RoleViewer, nil)
+	viewer := login(t, router, "users-viewer", "password", "192.0.2.50:1234")
+
+	w := serve(router, "POST", "/api/v0/users/users-admin/delete", "192.0.2.50:1234", nil, csrfHeaders(viewer))
+	areEqual("viewer delete", http.StatusForbidden, w.Code, t)
+}
+
+func TestLastAdmin(t *testing.T) {
+	config.CreateUser("last-admin", "", structs.RoleAdmin, nil)
+
+	// Other tests create administrators, so they are demoted until this test finishes
+	users, err := config.GetUsers()
+	if err != nil {
+		t.Fatalf("Unable to list users: %s", err)
+	}
+
+	for username, user := range users {
+		if user.Role != structs.RoleAdmin || username == "last-admin" {
+			continue
+		}
+
+		if err := config.SetRole(username, structs.RoleViewer); err != nil {
+			t.Fatalf("Unable to demote %s: %s", username, err)
+		}
+		defer config.SetRole(username, structs.RoleAdmin)
+	}
+
+	areEqual("demote last", true, errors.Is(config.SetRole("last-admin", structs.RoleViewer), config.ErrLastAdmin), t)
+	areEqual("delete last", true, errors.Is(config.DeleteUser("last-admin"), config.ErrLastAdmin), t)
+	areEqual("still admin", structs.RoleAdmin, config.GetRole("last-admin"), t)
+	areEqual("promote", nil, config.SetRole("last-admin", structs.RoleAdmin), t)
+
+	// Either can be removed once there is another administrator, but not both
+	config.CreateUser("last-admin-other", "", structs.RoleAdmin, nil)
+
+	areEqual("demote with another", nil, config.SetRole("last-admin", structs.RoleOperator), t)
+	areEqual("delete other", true, errors.Is(config.DeleteUser("last-admin-other"), config.ErrLastAdmin), t)
+
+	config.SetRole("last-admin", structs.RoleAdmin)
+	areEqual("delete with another", nil, config.DeleteUser("last-admin-other"), t)
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+// Turns the filter into a query string, skipping empty values
+function query(filter) {
+	let params = new URLSearchParams();
+	for (let key in filter) {
+		if (filter[key] !== '' && filter[key] !== undefined) {
+			params.append(key, filter[key]);
+		}
+	}
+
+	return params.toString();
+}
+
+export async function Query(filter) {
+	const res = await fetch('api/v0/audit?' + query(filter));
+	return await res.json();
+}
+
+export function ExportURL(filter) {
+	return 'api/v0/audit/export?' + query(filter);
+}
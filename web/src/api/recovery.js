@@ -0,0 +1,28 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+import * as ApiClient from '../apiClient.js';
+
+export async function Remaining() {
+	const res = await fetch('api/v0/tfa/recovery');
+	let json = await res.json();
+	return json.Remaining;
+}
+
+export async function Regenerate() {
+	const res = await ApiClient.Post('api/v0/tfa/recovery/regenerate', {});
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	let json = await res.json();
+	return json.Codes;
+}
+
+export async function Authenticate(code) {
+	const res = await ApiClient.Post('api/v0/tfa/recovery/authenticate', {
+		code: code
+	});
+
+	return Promise.resolve(res.ok);
+}
@@ -0,0 +1,18 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+import * as ApiClient from '../apiClient.js';
+
+export async function List() {
+	const res = await fetch('api/v0/sessions');
+	return await res.json();
+}
+
+export async function Revoke(id) {
+	const res = await ApiClient.Post('api/v0/sessions/' + encodeURIComponent(id) + '/revoke', {});
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	return Promise.resolve(true);
+}
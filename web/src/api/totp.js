@@ -4,18 +4,25 @@
 import * as ApiClient from '../apiClient.js';
 
 export async function Initialize() {
-	const res = await fetch('/api/v0/tfa/totp/initialize');
+	const res = await fetch('api/v0/tfa/totp/initialize');
 	return await res.json();
 }
 
 export async function IsEnabled() {
-	const res = await fetch('/api/v0/tfa/enabled');
+	const res = await fetch('api/v0/tfa/enabled');
 	let json = await res.json();
 	return json.Enabled;
 }
 
+// Returns every second factor that the current user has set up
+export async function GetProviders() {
+	const res = await fetch('api/v0/tfa/enabled');
+	let json = await res.json();
+	return json.Providers;
+}
+
 export async function Save(secret, code) {
-	const res = await ApiClient.Post('/api/v0/tfa/totp/save', {
+	const res = await ApiClient.Post('api/v0/tfa/totp/save', {
 		secret: secret,
 		code: code
 	});
@@ -24,11 +31,13 @@ export async function Save(secret, code) {
 		return Promise.reject(await res.text());
 	}
 
-	return Promise.resolve(true);
+	// Recovery codes are generated whenever TOTP is enabled
+	let json = await res.json();
+	return json.Codes;
 }
 
 export async function Authenticate(code) {
-	const res = await ApiClient.Post('/api/v0/tfa/totp/authenticate', {
+	const res = await ApiClient.Post('api/v0/tfa/totp/authenticate', {
 		code: code
 	});
 
@@ -0,0 +1,84 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+import * as ApiClient from '../apiClient.js';
+
+export async function List() {
+	const res = await fetch('api/v0/users');
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	return await res.json();
+}
+
+export async function Create(username, password, role) {
+	return await post('api/v0/users/create', {
+		Username: username,
+		Password: password,
+		Role: role
+	});
+}
+
+export async function Delete(username) {
+	return await post(userUrl(username, 'delete'), {});
+}
+
+export async function ResetPassword(username, password) {
+	return await post(userUrl(username, 'password'), {
+		Password: password
+	});
+}
+
+export async function DisableTwoFactor(username) {
+	return await post(userUrl(username, 'tfa/disable'), {});
+}
+
+export async function SetRole(username, role) {
+	return await post(userUrl(username, 'role'), {
+		Role: role
+	});
+}
+
+export async function SetScopes(username, scopes) {
+	return await post(userUrl(username, 'scopes'), {
+		Scopes: scopes
+	});
+}
+
+export async function ChangePassword(current, password) {
+	return await post('api/v0/account/password', {
+		Current: current,
+		Password: password
+	});
+}
+
+// Logs the user out everywhere
+export async function RevokeSessions(username) {
+	return await post(userUrl(username, 'sessions/revoke'), {});
+}
+
+export async function ListLockouts() {
+	const res = await fetch('api/v0/lockouts');
+	return await res.json();
+}
+
+export async function Unlock(kind, key) {
+	return await post('api/v0/lockouts/unlock', {
+		Kind: kind,
+		Key: key
+	});
+}
+
+function userUrl(username, action) {
+	return 'api/v0/users/' + encodeURIComponent(username) + '/' + action;
+}
+
+async function post(url, body) {
+	const res = await ApiClient.Post(url, body);
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	return Promise.resolve(true);
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+import * as ApiClient from '../apiClient.js';
+
+// Binary values are sent to and from the server as unpadded base64url
+function decode(encoded) {
+	let base64 = encoded.replace(/-/g, '+').replace(/_/g, '/');
+	let raw = atob(base64);
+	let buf = new Uint8Array(raw.length);
+
+	for (let i = 0; i < raw.length; i++) {
+		buf[i] = raw.charCodeAt(i);
+	}
+
+	return buf.buffer;
+}
+
+function encode(buf) {
+	let raw = String.fromCharCode.apply(null, new Uint8Array(buf));
+	return btoa(raw).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+function decodeDescriptors(list) {
+	return list.map(function(cred) {
+		return { type: cred.type, id: decode(cred.id) };
+	});
+}
+
+export function IsSupported() {
+	return window.PublicKeyCredential !== undefined;
+}
+
+export async function List() {
+	const res = await fetch('api/v0/tfa/webauthn/credentials');
+	return await res.json();
+}
+
+export async function Register(name) {
+	const res = await fetch('api/v0/tfa/webauthn/register');
+	let options = await res.json();
+
+	options.challenge = decode(options.challenge);
+	options.user.id = decode(options.user.id);
+	options.excludeCredentials = decodeDescriptors(options.excludeCredentials);
+
+	const cred = await navigator.credentials.create({ publicKey: options });
+
+	const saved = await ApiClient.Post('api/v0/tfa/webauthn/register', {
+		Name: name,
+		ClientData: encode(cred.response.clientDataJSON),
+		AttestationObject: encode(cred.response.attestationObject)
+	});
+
+	if (!saved.ok) {
+		return Promise.reject(await saved.text());
+	}
+
+	return Promise.resolve(true);
+}
+
+export async function Delete(id) {
+	const res = await ApiClient.Post('api/v0/tfa/webauthn/credentials/' + encodeURIComponent(id) + '/delete', {});
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	return Promise.resolve(true);
+}
+
+// Completes a login using the options returned by the two factor challenge
+export async function Authenticate(options) {
+	options.challenge = decode(options.challenge);
+	options.allowCredentials = decodeDescriptors(options.allowCredentials);
+
+	const cred = await navigator.credentials.get({ publicKey: options });
+
+	const res = await ApiClient.Post('api/v0/tfa/webauthn/authenticate', {
+		CredentialID: encode(cred.rawId),
+		ClientData: encode(cred.response.clientDataJSON),
+		AuthenticatorData: encode(cred.response.authenticatorData),
+		Signature: encode(cred.response.signature)
+	});
+
+	return Promise.resolve(res.ok);
+}
@@ -4,7 +4,7 @@
 let cachedInfo = {};
 let cachedProperties = {};
 
-export function Post(url, body) {
+export async function Post(url, body) {
 	// Transform the object into a URI encoded form (the hard way)
 	let data = [];
 	for (let key in body) {
@@ -12,24 +12,30 @@ export function Post(url, body) {
 	}
 	let postData = data.join('&');
 
+	// Every state changing request must include the CSRF token from the info endpoint
+	let info = await GetInfo();
+
 	// Send it
 	return fetch(url, {
 		method: 'POST',
 		headers: {
-			'Content-Type': 'application/x-www-form-urlencoded'
+			'Content-Type': 'application/x-www-form-urlencoded',
+			'X-CSRF-Token': info.CSRFToken
 		},
 		body: postData
 	});
 }
 
 export async function Login(username, password) {
-	const res = await Post('/api/v0/authenticate', {
+	const res = await Post('api/v0/authenticate', {
 		Username: username,
 		Password: password
 	});
 
-	if (!res.ok) {
-		return Promise.reject('Bad username/password');
+	if (res.status === 429) {
+		return Promise.reject(await res.text());
+	} else if (!res.ok) {
+		return Promise.reject('Invalid credentials');
 	}
 
 	let authType = await res.text();
@@ -55,14 +61,14 @@ export function Logout() {
 	cachedInfo = {};
 	cachedProperties = {};
 
-	return Post('/api/v0/logout');
+	return Post('api/v0/logout');
 }
 
 export async function GetInfo() {
 	if (cachedInfo.Authenticated !== undefined) {
 		return cachedInfo;
 	} else {
-		let info = await fetch('/api/v0/info').then(res => res.json());
+		let info = await fetch('api/v0/info').then(res => res.json());
 		
 		// Never cache info from before we are authenticated
 		if (info.Authenticated) {
@@ -77,12 +83,12 @@ export async function GetInfo() {
 }
 
 export async function GetPool(id) {
-	const res = await fetch('/api/v0/pool/' + encodeURIComponent(id));
+	const res = await fetch('api/v0/pool/' + encodeURIComponent(id));
 	return await res.json();
 }
 
 export async function GetPools() {
-	const res = await fetch('/api/v0/pools');
+	const res = await fetch('api/v0/pools');
 	return await res.json();
 }
 
@@ -91,7 +97,7 @@ export async function GetFields(table) {
 		return cachedProperties[table];
 	}
 
-	return await fetch('/api/v0/properties/' + table)
+	return await fetch('api/v0/properties/' + table)
 		.then(res => {
 			cachedProperties[table] = res.json();
 			return cachedProperties[table];
@@ -99,7 +105,7 @@ export async function GetFields(table) {
 }
 
 export async function GetSupportBundle() {
-	return await getText('/api/v0/support');
+	return await getText('api/v0/support');
 }
 
 async function getText(url) {
@@ -111,17 +117,17 @@ async function getText(url) {
 
 // TODO: is there a better way to encode these URLs?
 export async function Mount(id) {
-	const res = await Post('/api/v0/data/' + encodeURIComponent(id) + '/mount');
+	const res = await Post('api/v0/data/' + encodeURIComponent(id) + '/mount');
 	return await res.text();
 }
 
 export async function Unmount(id) {
-	const res = await Post('/api/v0/data/' + encodeURIComponent(id) + '/unmount');
+	const res = await Post('api/v0/data/' + encodeURIComponent(id) + '/unmount');
 	return await res.text();
 }
 
 export async function LoadKey(id, passphrase) {
-	const res = await Post('/api/v0/key/' + encodeURIComponent(id) + '/load', {
+	const res = await Post('api/v0/key/' + encodeURIComponent(id) + '/load', {
 		'id': id,
 		'Passphrase': passphrase
 	});
@@ -130,7 +136,7 @@ export async function LoadKey(id, passphrase) {
 }
 
 export async function UnloadKey(id) {
-	const res = await Post('/api/v0/key/' + encodeURIComponent(id) + '/unload', {
+	const res = await Post('api/v0/key/' + encodeURIComponent(id) + '/unload', {
 		'id': id
 	});
 
@@ -138,28 +144,46 @@ export async function UnloadKey(id) {
 }
 
 export async function Browse(id) {
-	const res = await fetch('/api/v0/files/browse/' + encodeURIComponent(id));
+	const res = await fetch('api/v0/files/browse/' + encodeURIComponent(id));
+	return await res.json();
+}
+
+export async function Search(id, query) {
+	const res = await fetch('api/v0/files/search/' + encodeURIComponent(id) + '?q=' + encodeURIComponent(query));
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
+	return await res.json();
+}
+
+export async function History(id, path) {
+	const res = await fetch('api/v0/files/history/' + encodeURIComponent(id) + '?path=' + encodeURIComponent(path));
+	if (!res.ok) {
+		return Promise.reject(await res.text());
+	}
+
 	return await res.json();
 }
 
 export async function Scrub(id) {
-	const res = await Post('/api/v0/pool/' + encodeURIComponent(id) + '/scrub/start');
+	const res = await Post('api/v0/pool/' + encodeURIComponent(id) + '/scrub/start');
 	return await res.text();
 }
 
 export async function PauseScrub(id) {
-	const res = await Post('/api/v0/pool/' + encodeURIComponent(id) + '/scrub/pause');
+	const res = await Post('api/v0/pool/' + encodeURIComponent(id) + '/scrub/pause');
 	return await res.text();
 }
 
 export async function GetNotifications() {
-	const res = await fetch('/api/v0/notifications/list');
+	const res = await fetch('api/v0/notifications/list');
 	
 	let list = await res.json();
 	return list.reverse();
 }
 
 export async function GetTwoFactorChallenge() {
-	const res = await fetch('/api/v0/tfa/challenge');
+	const res = await fetch('api/v0/tfa/challenge');
 	return await res.json();
 }
\ No newline at end of file
@@ -0,0 +1,130 @@
+// Copyright 2020 Matt Montgomery
+// SPDX-License-Identifier: AGPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ConfusedPolarBear/lifeguard/pkg/webauthn"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	testOrigin = "https://nas.example.com"
+	testRPID   = "nas.example.com"
+)
+
+// Builds authenticator data for testRPID, optionally including an attested credential
+func makeAuthData(flags byte, count uint32, credID []byte, key []byte) []byte {
+	hash := sha256.Sum256([]byte(testRPID))
+	data := append([]byte{}, hash[:]...)
+	data = append(data, flags)
+	data = append(data, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(data[33:], count)
+
+	if credID != nil {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(credID) >> 8), byte(len(credID)))
+		data = append(data, credID...)
+		data = append(data, key...)
+	}
+
+	return data
+}
+
+// Left pads a P-256 coordinate to 32 bytes
+func pad(raw []byte) []byte {
+	return append(make([]byte, 32 - len(raw)), raw...)
+}
+
+func makeClientData(kind string, challenge []byte, origin string) []byte {
+	raw, _ := json.Marshal(map[string]string {
+		"type":      kind,
+		"challenge": webauthn.Encode(challenge),
+		"origin":    origin,
+	})
+
+	return raw
+}
+
+func TestWebAuthn(t *testing.T) {
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	cose, _ := cbor.Marshal(map[int]interface{} {
+		1:  2,
+		3:  webauthn.AlgES256,
+		-1: 1,
+		-2: pad(priv.X.Bytes()),
+		-3: pad(priv.Y.Bytes()),
+	})
+
+	// Registration
+	challenge := []byte("registration challenge")
+	credID := []byte("credential")
+
+	attestation, _ := cbor.Marshal(map[string]interface{} {
+		"fmt":      "none",
+		"attStmt":  map[string]interface{} {},
+		"authData": makeAuthData(0x41, 1, credID, cose),
+	})
+
+	clientData := makeClientData("webauthn.create", challenge, testOrigin)
+
+	cred, err := webauthn.VerifyRegistration(clientData, attestation, challenge, testOrigin, testRPID)
+	if err != nil {
+		t.Fatalf("Unable to verify registration: %s", err)
+	}
+
+	areEqual("credential ID", string(credID), string(cred.ID), t)
+
+	_, err = webauthn.VerifyRegistration(clientData, attestation, []byte("other"), testOrigin, testRPID)
+	areEqual("registration challenge mismatch", webauthn.ErrChallenge, err, t)
+
+	_, err = webauthn.VerifyRegistration(clientData, attestation, challenge, testOrigin, "evil.example.com")
+	areEqual("registration relying party mismatch", webauthn.ErrRelyingParty, err, t)
+
+	// Assertion
+	challenge = []byte("assertion challenge")
+	clientData = makeClientData("webauthn.get", challenge, testOrigin)
+	authData := makeAuthData(0x01, 2, nil, nil)
+
+	sign := func(authData []byte, clientData []byte) []byte {
+		clientHash := sha256.Sum256(clientData)
+		hash := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+		r, s, _ := ecdsa.Sign(rand.Reader, priv, hash[:])
+		sig, _ := asn1.Marshal(struct { R, S *big.Int } { r, s })
+		return sig
+	}
+
+	count, err := webauthn.VerifyAssertion(*cred, clientData, authData, sign(authData, clientData), challenge, testOrigin, testRPID)
+	if err != nil {
+		t.Fatalf("Unable to verify assertion: %s", err)
+	}
+
+	areEqual("sign count", uint32(2), count, t)
+
+	wrongOrigin := makeClientData("webauthn.get", challenge, "https://evil.example.com")
+	_, err = webauthn.VerifyAssertion(*cred, wrongOrigin, authData, sign(authData, wrongOrigin), challenge, testOrigin, testRPID)
+	areEqual("origin mismatch", webauthn.ErrOrigin, err, t)
+
+	_, err = webauthn.VerifyAssertion(*cred, clientData, authData, sign(authData, []byte("{}")), challenge, testOrigin, testRPID)
+	areEqual("bad signature", webauthn.ErrSignature, err, t)
+
+	cred.SignCount = 2
+	_, err = webauthn.VerifyAssertion(*cred, clientData, authData, sign(authData, clientData), challenge, testOrigin, testRPID)
+	areEqual("replayed counter", webauthn.ErrSignCount, err, t)
+
+	notPresent := makeAuthData(0x00, 3, nil, nil)
+	_, err = webauthn.VerifyAssertion(*cred, clientData, notPresent, sign(notPresent, clientData), challenge, testOrigin, testRPID)
+	areEqual("user not present", webauthn.ErrUserPresence, err, t)
+}